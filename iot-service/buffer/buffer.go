@@ -0,0 +1,588 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	headerLen     = 12 // 8 byte unix nano timestamp + 4 byte record length
+
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+)
+
+// ErrFull is returned by Append if the queue reached its size limit and the overflow policy is drop_newest
+var ErrFull = errors.New("buffer is full - record dropped")
+
+// Config holds the settings of the on-disk store-and-forward buffer
+type Config struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	Directory   string `mapstructure:"directory"`
+	SegmentSize int64  `mapstructure:"segment_size_mb"`
+	MaxSize     int64  `mapstructure:"max_size_mb"`
+	MaxAge      int    `mapstructure:"max_age"`
+	Overflow    string `mapstructure:"overflow"`
+}
+
+// Queue is a persistent FIFO queue made of append-only segment files.
+// Records are written to the newest segment, read from the oldest one and a segment
+// is removed as soon as all of its records were consumed.
+//
+// Appended records survive a crash of the process, but they are only synced to disk when
+// their segment is rolled over and on Close, so a power loss can cost the records of the
+// newest segment. The read position is saved every 256 replayed records, records replayed
+// after the last save are replayed again after a crash.
+type Queue struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	maxSize     int64
+	maxAge      time.Duration
+	overflow    string
+
+	segments []uint64 // ordered ids of all segment files on disk
+	sizes    map[uint64]int64
+	writer   *os.File
+	readSeg  uint64
+	readOff  int64
+	records  int
+	dropped  uint64
+	commits  uint64
+
+	reader    *os.File
+	readerBuf *bufio.Reader
+	readerSeg uint64
+	readerOff int64
+}
+
+// Open loads an existing queue from the configured directory or creates a new one
+func Open(c Config) (*Queue, error) {
+
+	if c.Directory == "" {
+		c.Directory = "./data/buffer"
+	}
+
+	if c.SegmentSize <= 0 {
+		c.SegmentSize = 16
+	}
+
+	if c.MaxSize <= 0 {
+		c.MaxSize = 512
+	}
+
+	// at least two segments are needed to discard old data while writing new one
+	if c.SegmentSize*2 > c.MaxSize {
+		c.SegmentSize = max(c.MaxSize/2, 1)
+	}
+
+	switch c.Overflow {
+	case OverflowDropOldest, OverflowDropNewest:
+	case "":
+		c.Overflow = OverflowDropOldest
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", c.Overflow)
+	}
+
+	if err := os.MkdirAll(c.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		dir:         c.Directory,
+		segmentSize: c.SegmentSize << 20,
+		maxSize:     c.MaxSize << 20,
+		maxAge:      time.Duration(c.MaxAge) * time.Second,
+		overflow:    c.Overflow,
+		sizes:       make(map[uint64]int64),
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Append stores a record at the end of the queue
+func (q *Queue) Append(rec []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := int64(headerLen + len(rec))
+
+	// a record which can never fit must not evict the buffered records first
+	if size > q.maxSize {
+		q.dropped++
+		return ErrFull
+	}
+
+	for q.totalSize()+size > q.maxSize {
+		if q.overflow == OverflowDropNewest || len(q.segments) < 2 {
+			q.dropped++
+			return ErrFull
+		}
+		if err := q.dropOldestSegment(); err != nil {
+			return err
+		}
+	}
+
+	if q.writer == nil || q.sizes[q.headSegment()]+size > q.segmentSize {
+		if err := q.rollSegment(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(rec)))
+	copy(buf[headerLen:], rec)
+
+	if _, err := q.writer.Write(buf); err != nil {
+		return err
+	}
+
+	q.sizes[q.headSegment()] += size
+	q.records++
+	return nil
+}
+
+// Drain replays all buffered records in order by calling fn for each of them.
+// A record is only removed from the queue once fn returned without error, the first
+// error stops the drain and is returned together with the number of replayed records.
+// The queue is not locked while fn runs, so records can be appended during a drain.
+func (q *Queue) Drain(fn func(rec []byte) error) (int, error) {
+	n := 0
+
+	for {
+		rec, pos, ok, err := q.peek()
+
+		if err != nil || !ok {
+			return n, err
+		}
+
+		if err := fn(rec); err != nil {
+			q.mu.Lock()
+			q.saveCursor()
+			q.mu.Unlock()
+			return n, err
+		}
+
+		q.commit(pos, rec)
+		n++
+	}
+}
+
+// Len returns the number of records currently stored in the queue
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.records
+}
+
+// Size returns the number of bytes currently stored in the queue
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.totalSize()
+}
+
+// Dropped returns the number of records which were discarded due to size or age limits
+func (q *Queue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+// Close persists the read position and closes the current segment
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.saveCursor()
+	q.closeReader()
+
+	if q.writer != nil {
+		err := errors.Join(q.writer.Sync(), q.writer.Close())
+		q.writer = nil
+		return err
+	}
+	return nil
+}
+
+type position struct {
+	seg uint64
+	off int64
+}
+
+// peek returns the oldest record which is not expired, without removing it from the queue
+func (q *Queue) peek() ([]byte, position, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.segments) > 0 {
+
+		id := q.segments[0]
+
+		if q.readSeg != id {
+			q.readSeg = id
+			q.readOff = 0
+		}
+
+		if q.readOff >= q.sizes[id] {
+			if id == q.headSegment() {
+				// keep the head segment open for writing, truncate it once it is fully consumed
+				if q.readOff > 0 {
+					if err := q.resetHead(); err != nil {
+						return nil, position{}, false, err
+					}
+				}
+				return nil, position{}, false, nil
+			}
+
+			if err := q.removeSegment(id); err != nil {
+				return nil, position{}, false, err
+			}
+			continue
+		}
+
+		ts, rec, err := q.readAt(id, q.readOff)
+
+		if err == io.EOF {
+			// the segment is shorter than expected, skip its remainder
+			q.readOff = q.sizes[id]
+			continue
+		}
+
+		if err != nil {
+			return nil, position{}, false, err
+		}
+
+		if q.maxAge > 0 && time.Since(ts) > q.maxAge {
+			q.readOff += int64(headerLen + len(rec))
+			q.records--
+			q.dropped++
+			continue
+		}
+
+		return rec, position{seg: id, off: q.readOff}, true, nil
+	}
+
+	return nil, position{}, false, nil
+}
+
+// commit removes a record returned by peek, unless it was discarded by the overflow policy in the meantime
+func (q *Queue) commit(pos position, rec []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.readSeg != pos.seg || q.readOff != pos.off {
+		return
+	}
+
+	q.readOff += int64(headerLen + len(rec))
+	q.records--
+	q.commits++
+
+	if q.commits%256 == 0 {
+		q.saveCursor()
+	}
+}
+
+func (q *Queue) readAt(id uint64, off int64) (time.Time, []byte, error) {
+
+	if q.reader == nil || q.readerSeg != id || q.readerOff != off {
+		q.closeReader()
+
+		f, err := os.Open(q.segmentPath(id))
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			f.Close()
+			return time.Time{}, nil, err
+		}
+
+		q.reader = f
+		q.readerBuf = bufio.NewReader(f)
+		q.readerSeg = id
+		q.readerOff = off
+	}
+
+	ts, rec, err := readRecord(q.readerBuf, q.sizes[id]-off)
+	if err != nil {
+		q.closeReader()
+		return ts, rec, err
+	}
+
+	q.readerOff += int64(headerLen + len(rec))
+	return ts, rec, nil
+}
+
+func (q *Queue) closeReader() {
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+		q.readerBuf = nil
+	}
+}
+
+func (q *Queue) load() error {
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), segmentSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		q.segments = append(q.segments, id)
+	}
+
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	q.loadCursor()
+
+	for _, id := range q.segments {
+		valid, count, err := scanSegment(q.segmentPath(id))
+		if err != nil {
+			return err
+		}
+
+		// drop partially written records at the end of a segment, e.g. after a crash
+		if err := os.Truncate(q.segmentPath(id), valid); err != nil {
+			return err
+		}
+
+		q.sizes[id] = valid
+		q.records += count
+	}
+
+	if len(q.segments) > 0 {
+		if q.readSeg != q.segments[0] {
+			q.readSeg = q.segments[0]
+			q.readOff = 0
+		}
+
+		if q.readOff > 0 {
+			f, err := os.Open(q.segmentPath(q.readSeg))
+			if err != nil {
+				return err
+			}
+			consumed, _ := countRecords(bufio.NewReader(io.LimitReader(f, q.readOff)), q.readOff)
+			f.Close()
+			q.records -= consumed
+		}
+
+		w, err := os.OpenFile(q.segmentPath(q.headSegment()), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		q.writer = w
+	}
+
+	return nil
+}
+
+func (q *Queue) rollSegment() error {
+
+	var id uint64 = 1
+
+	if len(q.segments) > 0 {
+		id = q.headSegment() + 1
+	}
+
+	// the finished segment is synced, so a power loss can only affect the head segment
+	if q.writer != nil {
+		if err := errors.Join(q.writer.Sync(), q.writer.Close()); err != nil {
+			return err
+		}
+	}
+
+	w, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.writer = w
+	q.segments = append(q.segments, id)
+	q.sizes[id] = 0
+	return nil
+}
+
+func (q *Queue) resetHead() error {
+	id := q.headSegment()
+
+	q.closeReader()
+
+	if err := q.writer.Truncate(0); err != nil {
+		return err
+	}
+
+	q.sizes[id] = 0
+	q.readSeg = id
+	q.readOff = 0
+	return nil
+}
+
+func (q *Queue) dropOldestSegment() error {
+	id := q.segments[0]
+
+	f, err := os.Open(q.segmentPath(id))
+	if err != nil {
+		return err
+	}
+
+	var skip int64
+	if q.readSeg == id {
+		skip = q.readOff
+	}
+	f.Seek(skip, io.SeekStart)
+	count, _ := countRecords(bufio.NewReader(f), q.sizes[id]-skip)
+	f.Close()
+
+	q.records -= count
+	q.dropped += uint64(count)
+
+	return q.removeSegment(id)
+}
+
+func (q *Queue) removeSegment(id uint64) error {
+	if q.readerSeg == id {
+		q.closeReader()
+	}
+
+	if err := os.Remove(q.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	delete(q.sizes, id)
+	q.segments = q.segments[1:]
+
+	if len(q.segments) > 0 {
+		q.readSeg = q.segments[0]
+	}
+	q.readOff = 0
+	return nil
+}
+
+func (q *Queue) headSegment() uint64 {
+	if len(q.segments) == 0 {
+		return 0
+	}
+	return q.segments[len(q.segments)-1]
+}
+
+func (q *Queue) totalSize() int64 {
+	var s int64
+	for _, v := range q.sizes {
+		s += v
+	}
+	return s
+}
+
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func (q *Queue) loadCursor() {
+	b, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	if err != nil {
+		return
+	}
+
+	var seg uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seg, &off); err != nil {
+		return
+	}
+
+	q.readSeg = seg
+	q.readOff = off
+}
+
+func (q *Queue) saveCursor() {
+	os.WriteFile(filepath.Join(q.dir, cursorFile), fmt.Appendf(nil, "%d %d", q.readSeg, q.readOff), 0644)
+}
+
+// readRecord reads the next record, left is the number of bytes remaining in the segment.
+// A record length exceeding them is treated like a truncated record, so a corrupt header
+// never leads to a huge allocation
+func readRecord(r *bufio.Reader, left int64) (time.Time, []byte, error) {
+	h := make([]byte, headerLen)
+
+	if _, err := io.ReadFull(r, h); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return time.Time{}, nil, io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(h[8:12]))
+	if headerLen+length > left {
+		return time.Time{}, nil, io.EOF
+	}
+
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(h[0:8])))
+	rec := make([]byte, length)
+
+	if _, err := io.ReadFull(r, rec); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return time.Time{}, nil, io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+
+	return ts, rec, nil
+}
+
+func countRecords(r *bufio.Reader, size int64) (int, int64) {
+	var n int
+	var off int64
+	for {
+		_, rec, err := readRecord(r, size-off)
+		if err != nil {
+			return n, off
+		}
+		n++
+		off += int64(headerLen + len(rec))
+	}
+}
+
+// scanSegment returns the length of the valid part of a segment and the number of complete records in it
+func scanSegment(path string) (int64, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n, off := countRecords(bufio.NewReader(f), info.Size())
+	return off, n, nil
+}
@@ -0,0 +1,273 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openQueue opens a queue with segments of 1 KiB and a limit of 4 KiB, so the tests roll over quickly
+func openQueue(t *testing.T, dir string, overflow string, maxAge int) *Queue {
+	t.Helper()
+
+	q, err := Open(Config{Directory: dir, Overflow: overflow, MaxAge: maxAge})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.segmentSize = 1 << 10
+	q.maxSize = 4 << 10
+	return q
+}
+
+func record(i int) []byte {
+	return fmt.Appendf(make([]byte, 0, 100), "%0100d", i)
+}
+
+func appendN(t *testing.T, q *Queue, from, n int) {
+	t.Helper()
+
+	for i := from; i < from+n; i++ {
+		if err := q.Append(record(i)); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+}
+
+func drainAll(t *testing.T, q *Queue) []string {
+	t.Helper()
+
+	var got []string
+	if _, err := q.Drain(func(rec []byte) error {
+		got = append(got, string(rec))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func expectRecords(t *testing.T, got []string, from, to int) {
+	t.Helper()
+
+	if len(got) != to-from {
+		t.Fatalf("expected %d records, got %d", to-from, len(got))
+	}
+	for i, rec := range got {
+		if rec != string(record(from+i)) {
+			t.Fatalf("record %d: expected %d, got %s", i, from+i, rec)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	m, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSegmentRollover(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, OverflowDropOldest, 0)
+	defer q.Close()
+
+	// 112 bytes per record, 9 records fit into a segment
+	appendN(t, q, 0, 30)
+
+	if n := len(segmentFiles(t, dir)); n != 4 {
+		t.Fatalf("expected 4 segments, got %d", n)
+	}
+	if q.Len() != 30 {
+		t.Fatalf("expected 30 records, got %d", q.Len())
+	}
+
+	expectRecords(t, drainAll(t, q), 0, 30)
+
+	// consumed segments are removed, only the head segment is kept for writing
+	if n := len(segmentFiles(t, dir)); n != 1 {
+		t.Fatalf("expected 1 segment after the drain, got %d", n)
+	}
+	if q.Len() != 0 || q.Size() != 0 {
+		t.Fatalf("expected an empty queue, got %d records with %d bytes", q.Len(), q.Size())
+	}
+}
+
+func TestCursor(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, OverflowDropOldest, 0)
+
+	appendN(t, q, 0, 20)
+
+	// the failing record stops the drain and is kept
+	stop := errors.New("exporter unavailable")
+	n, err := q.Drain(func(rec []byte) error {
+		if string(rec) == string(record(5)) {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || n != 5 {
+		t.Fatalf("expected 5 records and the exporter error, got %d and %v", n, err)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, dir, OverflowDropOldest, 0)
+	defer q.Close()
+
+	if q.Len() != 15 {
+		t.Fatalf("expected 15 records after reopening, got %d", q.Len())
+	}
+
+	expectRecords(t, drainAll(t, q), 5, 20)
+}
+
+func TestLoadTruncatesPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, OverflowDropOldest, 0)
+
+	appendN(t, q, 0, 3)
+	q.Close()
+
+	files := segmentFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 segment, got %d", len(files))
+	}
+
+	// a crash in the middle of a write leaves half a record behind
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := make([]byte, headerLen)
+	binary.BigEndian.PutUint64(h[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(h[8:12], 100)
+	f.Write(append(h, record(3)[:10]...))
+	f.Close()
+
+	q = openQueue(t, dir, OverflowDropOldest, 0)
+
+	if q.Len() != 3 {
+		t.Fatalf("expected 3 records, got %d", q.Len())
+	}
+
+	// records appended after the truncation follow the valid ones
+	appendN(t, q, 3, 2)
+	expectRecords(t, drainAll(t, q), 0, 5)
+	q.Close()
+}
+
+func TestLoadRejectsCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir, OverflowDropOldest, 0)
+
+	appendN(t, q, 0, 2)
+	q.Close()
+
+	files := segmentFiles(t, dir)
+
+	// a header claiming 4 GiB must not be allocated, it is treated like a truncated record
+	h := make([]byte, headerLen)
+	binary.BigEndian.PutUint64(h[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(h[8:12], 0xffffffff)
+
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(append(h, record(2)...))
+	f.Close()
+
+	q = openQueue(t, dir, OverflowDropOldest, 0)
+	defer q.Close()
+
+	expectRecords(t, drainAll(t, q), 0, 2)
+}
+
+func TestOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		overflow string
+		from, to int
+	}{
+		// the oldest segments are discarded to make room for new records
+		{overflow: OverflowDropOldest, from: 18, to: 50},
+		// new records are rejected once the limit is reached
+		{overflow: OverflowDropNewest, from: 0, to: 36},
+	} {
+		t.Run(tc.overflow, func(t *testing.T) {
+			q := openQueue(t, t.TempDir(), tc.overflow, 0)
+			defer q.Close()
+
+			var full int
+			for i := 0; i < 50; i++ {
+				err := q.Append(record(i))
+				if errors.Is(err, ErrFull) {
+					full++
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if q.Size() > 4<<10 {
+				t.Fatalf("queue exceeds its limit: %d bytes", q.Size())
+			}
+
+			if tc.overflow == OverflowDropNewest && full != 50-tc.to {
+				t.Fatalf("expected %d rejected records, got %d", 50-tc.to, full)
+			}
+
+			if d := q.Dropped(); d != uint64(50-(tc.to-tc.from)) {
+				t.Fatalf("expected %d dropped records, got %d", 50-(tc.to-tc.from), d)
+			}
+
+			expectRecords(t, drainAll(t, q), tc.from, tc.to)
+		})
+	}
+}
+
+func TestOversizedRecord(t *testing.T) {
+	q := openQueue(t, t.TempDir(), OverflowDropOldest, 0)
+	defer q.Close()
+
+	appendN(t, q, 0, 20)
+
+	// the record exceeds the limit of the queue, the buffered records are kept
+	if err := q.Append(make([]byte, 4<<10)); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+	if q.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped record, got %d", q.Dropped())
+	}
+
+	expectRecords(t, drainAll(t, q), 0, 20)
+}
+
+func TestMaxAge(t *testing.T) {
+	q := openQueue(t, t.TempDir(), OverflowDropOldest, 1)
+	defer q.Close()
+
+	appendN(t, q, 0, 5)
+	time.Sleep(1100 * time.Millisecond)
+	appendN(t, q, 5, 3)
+
+	expectRecords(t, drainAll(t, q), 5, 8)
+
+	if q.Dropped() != 5 {
+		t.Fatalf("expected 5 expired records, got %d", q.Dropped())
+	}
+	if q.Len() != 0 {
+		t.Fatalf("expected an empty queue, got %d records", q.Len())
+	}
+}
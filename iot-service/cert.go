@@ -1,35 +1,149 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"gualogger/logging"
 	"math/big"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
-func CreateKeyPair() error {
+// certMu serializes the creation, renewal and loading of application certificates, servers may share a directory
+var certMu sync.Mutex
 
-	_, err0 := os.Stat("./certs")
+// ensureKeyPair loads the application certificate and key of the connection. Auto created certificates are created
+// if they are missing and replaced if they expire within the renewal period or their ApplicationURI does not match
+func ensureKeyPair(c *OpcCerts) ([]byte, *rsa.PrivateKey, error) {
 
-	if err0 != nil {
-		os.Mkdir("certs", 0777)
+	certMu.Lock()
+	defer certMu.Unlock()
+
+	certFile, keyFile := c.files()
+
+	if c.AutoCreate {
+		if reason := c.renewal(certFile, keyFile); reason != "" {
+			logging.Logger.Info(fmt.Sprintf("creating application certificate %s: %s", certFile, reason))
+
+			if err := CreateKeyPair(certFile, keyFile, c); err != nil {
+				return nil, nil, fmt.Errorf("error creating application certificate: %w", err)
+			}
+		}
+	}
+
+	cert, key, err := loadKeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading application certificate: %w", err)
+	}
+
+	if x, err := x509.ParseCertificate(cert); err == nil && !c.AutoCreate && time.Until(x.NotAfter) < c.renewBefore() {
+		logging.Logger.Warn(fmt.Sprintf("application certificate %s expires on %s and has to be replaced", certFile, x.NotAfter.Format(time.RFC3339)), "func", "ensureKeyPair")
+	}
+
+	return cert, key, nil
+}
+
+// renewCheckInterval is the interval in which the application certificate is checked for renewal
+const renewCheckInterval = time.Hour
+
+// renewCertificate renews the application certificate before it expires and reconnects, once the certificate of the
+// session was replaced, by this server, another server sharing the directory or an operator
+func (s *OpcServer) renewCertificate(ctx context.Context) {
+
+	t := time.NewTicker(renewCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		inUse := s.cert.Load()
+		if inUse == nil {
+			continue
+		}
+
+		conf := s.config().Connection.Certificate
+
+		cert, _, err := ensureKeyPair(&conf)
+
+		if err != nil {
+			logging.Logger.Error(err.Error(), "func", "renewCertificate", "server", s.Name)
+			continue
+		}
+
+		if !bytes.Equal(cert, *inUse) {
+			logging.Logger.Info(fmt.Sprintf("application certificate of server %s changed - reconnecting", s.Name))
+			s.sv.Restart()
+		}
 	}
+}
+
+// renewal returns why the certificate has to be created, an empty string if it is still valid
+// A key which does not belong to the certificate, e.g. after a crash while both were written, is replaced as well
+func (c *OpcCerts) renewal(certFile, keyFile string) string {
 
-	_, err1 := os.Stat("./certs/cert.pem")
-	_, err2 := os.Stat("./certs/key.pem")
+	b, err := os.ReadFile(certFile)
 
-	if err1 == nil && err2 == nil {
-		logging.Logger.Info("certificate and key already present - skipping creating")
-		return nil
+	if errors.Is(err, os.ErrNotExist) {
+		return "certificate does not exist"
+	}
+	if err != nil {
+		return err.Error()
 	}
 
-	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	ders := decodePEM(b, "CERTIFICATE")
+	if len(ders) == 0 {
+		return "file contains no certificate"
+	}
+
+	cert, err := x509.ParseCertificate(ders[0])
+	if err != nil {
+		return err.Error()
+	}
+
+	if time.Until(cert.NotAfter) < c.renewBefore() {
+		return fmt.Sprintf("certificate expires on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	if len(cert.URIs) == 0 || cert.URIs[0].String() != c.applicationURI() {
+		return fmt.Sprintf("certificate does not contain the ApplicationURI %s", c.applicationURI())
+	}
+
+	if _, _, err := loadKeyPair(certFile, keyFile); err != nil {
+		return err.Error()
+	}
+
+	return ""
+}
+
+// CreateKeyPair creates a self-signed application instance certificate and key at the given paths following OPC UA
+// Part 6: the ApplicationURI and the host names are subject alternative names and the serial number is random
+// Existing files are replaced
+func CreateKeyPair(certFile, keyFile string, c *OpcCerts) error {
+
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	pk, err := rsa.GenerateKey(rand.Reader, c.keySize())
 
 	if err != nil {
 		return err
@@ -41,51 +155,136 @@ func CreateKeyPair() error {
 		return err
 	}
 
-	u, err := url.Parse(hostName)
+	u, err := url.Parse(c.applicationURI())
+
+	if err != nil {
+		return fmt.Errorf("invalid application uri: %w", err)
+	}
+
+	// serial numbers are positive and at most 20 bytes long
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 159))
 
 	if err != nil {
 		return err
 	}
 
-	ca := x509.Certificate{
-		SerialNumber:          big.NewInt(1),
-		Subject:               pkix.Name{Country: []string{"DE"}, Organization: []string{"Geist@" + hostName}},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(24 * 3650 * time.Hour),
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign | x509.KeyUsageContentCommitment,
+	now := time.Now()
+
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "geist@" + hostName,
+			Organization: []string{"Geist"},
+			ExtraNames:   []pkix.AttributeTypeAndValue{{Type: oidDomainComponent, Value: hostName}},
+		},
+		// the certificate is valid slightly before its creation, so clocks running behind do not reject it
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(c.validity()),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageCertSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		URIs:                  []*url.URL{u},
+		DNSNames:              []string{hostName},
+	}
+
+	for _, h := range c.Hostnames {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != hostName {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
 	}
 
-	bArr, err := x509.CreateCertificate(rand.Reader, &ca, &ca, &pk.PublicKey, pk)
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &pk.PublicKey, pk)
 
 	if err != nil {
 		return err
 	}
-	cert, err := os.Create("./certs/cert.pem")
 
-	if err != nil {
+	// the key is written first, so the certificate never refers to a key which is not there yet
+	if err := writeFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)}), 0600); err != nil {
 		return err
 	}
 
-	defer cert.Close()
+	return writeFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// oidDomainComponent is the DC attribute, which holds the host name in the subject of application certificates
+var oidDomainComponent = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}
+
+// writeFile replaces the file atomically, so a concurrent reader never sees a partially written file
+func writeFile(path string, b []byte, perm os.FileMode) error {
+
+	tmp := path + ".tmp"
 
-	if err := pem.Encode(cert, &pem.Block{Type: "CERTIFICATE", Bytes: bArr}); err != nil {
+	if err := os.WriteFile(tmp, b, perm); err != nil {
 		return err
 	}
 
-	key, err := os.Create("./certs/key.pem")
+	return os.Rename(tmp, path)
+}
+
+// loadKeyPair loads a certificate and its private key, both may be PEM or DER encoded
+// The key has to be an RSA key in PKCS #1 or PKCS #8 format and match the public key of the certificate
+func loadKeyPair(certPath, keyPath string) ([]byte, *rsa.PrivateKey, error) {
+
+	cert, err := os.ReadFile(certPath)
 
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	if block, _ := pem.Decode(cert); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, nil, fmt.Errorf("%s contains no certificate but %s", certPath, block.Type)
+		}
+		cert = block.Bytes
 	}
 
-	defer key.Close()
+	x, err := x509.ParseCertificate(cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %w", certPath, err)
+	}
 
-	if err := pem.Encode(key, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)}); err != nil {
-		return err
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !key.PublicKey.Equal(x.PublicKey) {
+		return nil, nil, fmt.Errorf("private key %s does not belong to certificate %s", keyPath, certPath)
+	}
+
+	return cert, key, nil
+}
+
+func loadKey(keyPath string) (*rsa.PrivateKey, error) {
+
+	der, err := os.ReadFile(keyPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(der)
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", keyPath, err)
+	}
+
+	key, ok := k.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, errors.New("opcua requires an RSA private key")
 	}
 
-	return nil
+	return key, nil
 }
@@ -1,24 +1,133 @@
 package main
 
 import (
+	"fmt"
+	"gualogger/buffer"
 	"gualogger/handlers"
+	"gualogger/logging"
+	"gualogger/supervisor"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/gopcua/opcua/ua"
 	"github.com/spf13/viper"
 )
 
 type Configuration struct {
 	Opcua    OpcConfig         `mapstructure:"opcua"`
 	Redpanda handlers.Redpanda `mapstructure:"redpanda"`
+	MQTT     handlers.MQTT     `mapstructure:"mqtt"`
+	Buffer   buffer.Config     `mapstructure:"buffer"`
+	Export   ExportConfig      `mapstructure:"export"`
+	HTTP     HTTPConfig        `mapstructure:"http"`
+	Metrics  MetricsConfig     `mapstructure:"metrics"`
+	Shutdown ShutdownConfig    `mapstructure:"shutdown"`
+
+	// Exporters holds all exporters whose config section is present
+	Exporters map[string]handlers.Exporter `mapstructure:"-"`
+
+	v *viper.Viper
 }
 
+// OpcConfig holds the settings of a single opcua server
+// Additional servers are configured as named entries in 'connections', which use the same fields
 type OpcConfig struct {
-	Connection   OpcConnection `mapstructure:"connection"`
-	Subscription Subscription  `mapstructure:"subscription"`
+	Name          string              `mapstructure:"name"`
+	Connection    OpcConnection       `mapstructure:"connection"`
+	Subscription  Subscription        `mapstructure:"subscription"`
+	Subscriptions []Subscription      `mapstructure:"subscriptions"`
+	Events        []EventSubscription `mapstructure:"events"`
+	Writable      []WritableNode      `mapstructure:"writable"`
+	Callable      []CallableMethod    `mapstructure:"callable"`
+	Connections   []OpcConfig         `mapstructure:"connections"`
+}
+
+// WritableNode allows write requests to a node, Datatype restricts the requests to a single datatype if set
+type WritableNode struct {
+	Id       string `mapstructure:"id"`
+	Datatype string `mapstructure:"datatype"`
 }
 
+// Servers returns the settings of all configured opcua servers
+// The top level connection is kept as server 'default' if an endpoint is set
+func (o *OpcConfig) Servers() ([]OpcConfig, error) {
+
+	servers := make([]OpcConfig, 0, len(o.Connections)+1)
+
+	if o.Connection.Endpoint != "" {
+		s := *o
+		s.Connections = nil
+		if s.Name == "" {
+			s.Name = "default"
+		}
+		servers = append(servers, s)
+	}
+
+	servers = append(servers, o.Connections...)
+
+	names := make(map[string]bool)
+
+	for i, s := range servers {
+		if s.Name == "" {
+			return nil, fmt.Errorf("opcua connection %d has no name", i)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate opcua connection name %s", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	return servers, nil
+}
+
+// Subscription is a group of nodes sharing one opcua subscription, or which are read periodically in poll mode
+// The interval and jitter are given in seconds, fractions like 0.1 are allowed
 type Subscription struct {
-	Nodeids  []Nodeid `mapstructure:"nodeids"`
-	Interval int      `mapstructure:"sub_interval"`
+	Name              string   `mapstructure:"name"`
+	Nodeids           []Nodeid `mapstructure:"nodeids"`
+	Interval          float64  `mapstructure:"sub_interval"`
+	LifetimeCount     uint32   `mapstructure:"lifetime_count"`
+	MaxKeepAliveCount uint32   `mapstructure:"max_keepalive_count"`
+	Priority          uint8    `mapstructure:"priority"`
+	Mode              string   `mapstructure:"mode"`
+	Jitter            float64  `mapstructure:"jitter"`
+	ResolveInterval   float64  `mapstructure:"resolve_interval"`
+	Enrich            bool     `mapstructure:"enrich"`
+}
+
+// SubscriptionGroups returns all configured subscription groups
+// The legacy 'subscription' block is kept as group 'default' if it contains nodes
+func (o *OpcConfig) SubscriptionGroups() []Subscription {
+
+	groups := make([]Subscription, 0, len(o.Subscriptions)+1)
+
+	if len(o.Subscription.Nodeids) > 0 {
+		g := o.Subscription
+		if g.Name == "" {
+			g.Name = "default"
+		}
+		groups = append(groups, g)
+	}
+
+	for i, g := range o.Subscriptions {
+		if g.Name == "" {
+			g.Name = fmt.Sprintf("group-%d", i)
+		}
+		groups = append(groups, g)
+	}
+
+	return groups
+}
+
+// publishingInterval returns the interval of the group, falling back to 10 seconds if none is set
+func (s *Subscription) publishingInterval() time.Duration {
+	if s.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(s.Interval * float64(time.Second))
 }
 
 type OpcConnection struct {
@@ -29,6 +138,42 @@ type OpcConnection struct {
 	Authentication OpcAuthentication `mapstructure:"authentication"`
 	Certificate    OpcCerts          `mapstructure:"certificate"`
 	Retries        int               `mapstructure:"retry_count"`
+
+	// Backoff, KeepaliveInterval and DegradedTimeout are given in seconds
+	Backoff           supervisor.Backoff `mapstructure:"backoff"`
+	KeepaliveInterval float64            `mapstructure:"keepalive_interval"`
+	DegradedTimeout   float64            `mapstructure:"degraded_timeout"`
+}
+
+// keepaliveInterval returns the interval in which the session is checked, 0 selects the default of the supervisor
+func (c *OpcConnection) keepaliveInterval() time.Duration {
+	return time.Duration(c.KeepaliveInterval * float64(time.Second))
+}
+
+// degradedTimeout returns the time a lost session gets to recover before it is replaced, 0 selects the default of the supervisor
+func (c *OpcConnection) degradedTimeout() time.Duration {
+	return time.Duration(c.DegradedTimeout * float64(time.Second))
+}
+
+// CallableMethod allows call requests of a method, Object restricts the calls to a single object node if set
+type CallableMethod struct {
+	Object string `mapstructure:"object"`
+	Method string `mapstructure:"method"`
+}
+
+// ShutdownConfig holds the settings of a graceful shutdown after SIGTERM
+type ShutdownConfig struct {
+	// GracePeriod is the time in seconds to stop acquisition and flush the exporters, it has to be below the
+	// termination grace period of the pod
+	GracePeriod float64 `mapstructure:"grace_period"`
+}
+
+// gracePeriod returns the time the shutdown may take, defaults to 25s which fits the default pod grace period of 30s
+func (s *ShutdownConfig) gracePeriod() time.Duration {
+	if s.GracePeriod <= 0 {
+		return 25 * time.Second
+	}
+	return time.Duration(s.GracePeriod * float64(time.Second))
 }
 
 type OpcAuthentication struct {
@@ -39,25 +184,146 @@ type OpcAuthentication struct {
 	} `mapstructure:"credentials"`
 	Certificate struct {
 		CertificatePath string `mapstructure:"certificate_path"`
-		// PrivateKeyPath  string `mapstructure:"private_key_path"`
+		PrivateKeyPath  string `mapstructure:"private_key_path"`
 	} `mapstructure:"certificate"`
 }
 
+// userTokenType returns the user identity token type of the authentication type
+func (a *OpcAuthentication) userTokenType() ua.UserTokenType {
+	switch a.Type {
+	case "User&Password":
+		return ua.UserTokenTypeUserName
+	case "Certificate":
+		return ua.UserTokenTypeCertificate
+	default:
+		return ua.UserTokenTypeAnonymous
+	}
+}
+
+// userCertificate returns the paths of the user certificate and key, which default to user-cert.pem and user-key.pem
+// in the certificate directory, so they can be provided by the mounted certificate secret
+func (a *OpcAuthentication) userCertificate(dir string) (string, string) {
+
+	cert, key := a.Certificate.CertificatePath, a.Certificate.PrivateKeyPath
+
+	if cert == "" {
+		cert = filepath.Join(dir, "user-cert.pem")
+	}
+	if key == "" {
+		key = filepath.Join(dir, "user-key.pem")
+	}
+
+	return cert, key
+}
+
 type OpcCerts struct {
-	AutoCreate bool `mapstructure:"auto_create"`
-	// CertificatePath string `mapstructure:"certificate_path"`
-	// PrivateKeyPath  string `mapstructure:"private_key_path"`
+	AutoCreate      bool   `mapstructure:"auto_create"`
+	Directory       string `mapstructure:"directory"`
+	CertificatePath string `mapstructure:"certificate_path"`
+	PrivateKeyPath  string `mapstructure:"private_key_path"`
+	// PKI is the directory of the own certificate and the trust lists, server certificates are only validated if it is set
+	PKI string `mapstructure:"pki_directory"`
+
+	// ApplicationURI, Hostnames, KeySize and ValidityDays are used for auto created certificates, which are renewed
+	// RenewBeforeDays before they expire
+	ApplicationURI  string   `mapstructure:"application_uri"`
+	Hostnames       []string `mapstructure:"hostnames"`
+	KeySize         int      `mapstructure:"key_size"`
+	ValidityDays    int      `mapstructure:"validity_days"`
+	RenewBeforeDays int      `mapstructure:"renew_before_days"`
 }
 
+// applicationURI returns the ApplicationURI of the client, defaults to urn:<hostname>:geist
+func (c *OpcCerts) applicationURI() string {
+	if c.ApplicationURI != "" {
+		return c.ApplicationURI
+	}
+	h, _ := os.Hostname()
+	return fmt.Sprintf("urn:%s:geist", h)
+}
+
+// keySize returns the size of generated rsa keys, defaults to 2048 bits
+func (c *OpcCerts) keySize() int {
+	if c.KeySize <= 0 {
+		return 2048
+	}
+	return c.KeySize
+}
+
+// validity returns the lifetime of generated certificates, defaults to one year
+func (c *OpcCerts) validity() time.Duration {
+	if c.ValidityDays <= 0 {
+		return 365 * 24 * time.Hour
+	}
+	return time.Duration(c.ValidityDays) * 24 * time.Hour
+}
+
+// renewBefore returns the time before the expiry in which certificates are renewed, defaults to 30 days
+// It is limited to half the validity, so short lived certificates are not renewed right after their creation
+func (c *OpcCerts) renewBefore() time.Duration {
+	d := 30 * 24 * time.Hour
+	if c.RenewBeforeDays > 0 {
+		d = time.Duration(c.RenewBeforeDays) * 24 * time.Hour
+	}
+	return min(d, c.validity()/2)
+}
+
+// files returns the paths of the application certificate and key
+// Explicit paths take precedence over the own directory of the pki and the certificate directory
+func (c *OpcCerts) files() (string, string) {
+
+	cert, key := filepath.Join(c.dir(), "cert.pem"), filepath.Join(c.dir(), "key.pem")
+
+	if c.PKI != "" {
+		cert, key = filepath.Join(c.PKI, "own", "certs", "cert.pem"), filepath.Join(c.PKI, "own", "private", "key.pem")
+	}
+
+	if c.CertificatePath != "" {
+		cert = c.CertificatePath
+	}
+	if c.PrivateKeyPath != "" {
+		key = c.PrivateKeyPath
+	}
+
+	return cert, key
+}
+
+// Nodeid is either a single node or a selector, which is resolved against the server on connect
+// Selectors match nodes by browse path or all nodes below a root node up to a depth
 type Nodeid struct {
-	Id     string          `mapstructure:"id"`
-	Topics []string        `mapstructure:"topics"`
-	Meta   []handlers.Meta `mapstructure:"meta"`
+	Id               string          `mapstructure:"id"`
+	BrowsePath       string          `mapstructure:"browse_path"`
+	Root             string          `mapstructure:"root"`
+	Depth            int             `mapstructure:"depth"`
+	NodeClass        []string        `mapstructure:"node_class"`
+	DataType         []string        `mapstructure:"data_type"`
+	Topics           []string        `mapstructure:"topics"`
+	Meta             []handlers.Meta `mapstructure:"meta"`
+	SamplingInterval float64         `mapstructure:"sampling_interval"`
+	QueueSize        uint32          `mapstructure:"queue_size"`
+	DiscardPolicy    string          `mapstructure:"discard_policy"`
+	Trigger          string          `mapstructure:"trigger"`
+	Deadband         Deadband        `mapstructure:"deadband"`
+	MinQuality       string          `mapstructure:"min_quality"`
 }
 
-func LoadConfig() (*Configuration, error) {
+type Deadband struct {
+	Type  string  `mapstructure:"type"`
+	Value float64 `mapstructure:"value"`
+}
+
+// dir returns the directory of the application certificate and key, defaults to ./certs
+func (c *OpcCerts) dir() string {
+	if c.Directory == "" {
+		return "./certs"
+	}
+	return c.Directory
+}
+
+// configDebounce is the time without further changes of the config file before it is reloaded
+const configDebounce = time.Second
 
-	var conf Configuration
+func LoadConfig() (*Configuration, error) {
 
 	v := viper.New()
 	v.SetConfigName("config")
@@ -67,15 +333,77 @@ func LoadConfig() (*Configuration, error) {
 	v.AddConfigPath("./configs")     // Local Testing
 
 	if err := v.ReadInConfig(); err != nil {
-		return &conf, err
+		return &Configuration{}, err
 	}
 
+	return decodeConfig(v)
+}
+
+func decodeConfig(v *viper.Viper) (*Configuration, error) {
+
+	conf := Configuration{v: v}
+
 	if err := v.Unmarshal(&conf); err != nil {
 		return &conf, err
 	}
 
+	conf.Exporters = make(map[string]handlers.Exporter)
+
+	for k, e := range conf.exporterRegistry() {
+		if v.IsSet(k) {
+			conf.Exporters[k] = e
+		}
+	}
+
 	return &conf, nil
 }
 
+// Watch calls fn with the new configuration whenever the config file changes, invalid files are logged and skipped
+// The symlink swap of a mounted ConfigMap is detected as well. Only the opcua settings are applied at runtime,
+// changes of exporters or buffering require a restart
+func (c *Configuration) Watch(fn func(*Configuration)) {
+
+	var mu sync.Mutex
+	var t *time.Timer
+
+	// editors write a file in several steps, so the file is read once no event arrived for the debounce time
+	reload := func() {
+		v := viper.New()
+		v.SetConfigFile(c.v.ConfigFileUsed())
+
+		if err := v.ReadInConfig(); err != nil {
+			logging.Logger.Error(fmt.Sprintf("error while reading changed configuration: %s", err.Error()), "func", "Watch")
+			return
+		}
+
+		n, err := decodeConfig(v)
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("error while loading changed configuration: %s", err.Error()), "func", "Watch")
+			return
+		}
+
+		logging.Logger.Info(fmt.Sprintf("configuration file %s changed", v.ConfigFileUsed()))
+		fn(n)
+	}
+
+	c.v.OnConfigChange(func(e fsnotify.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if t != nil {
+			t.Stop()
+		}
+		t = time.AfterFunc(configDebounce, reload)
+	})
+
+	c.v.WatchConfig()
+}
+
 // Returns a map of all possible Exporters
 // To add a new Exporter add a new entry in format [`conf key name`]=Exporter struct
+func (c *Configuration) exporterRegistry() map[string]handlers.Exporter {
+	return map[string]handlers.Exporter{
+		"redpanda": &c.Redpanda,
+		"mqtt":     &c.MQTT,
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"slices"
+	"strings"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// maxBrowsePathDepth limits the inverse browse of a node towards the Objects folder
+const maxBrowsePathDepth = 32
+
+// nodeInfo holds everything which is published along with the values of a node
+type nodeInfo struct {
+	topics     []string
+	meta       []handlers.Meta
+	minQuality string
+	group      string
+
+	// name and attrs are read from the server if enrichment is enabled for the group of the node
+	name  string
+	attrs []handlers.Meta
+}
+
+// describe sets the name, topics and meta of a payload from the cached information of the node
+func (s *OpcServer) describe(p *handlers.Payload, key string) {
+
+	s.nodesMu.RLock()
+	defer s.nodesMu.RUnlock()
+
+	n, ok := s.nodes[key]
+	if !ok {
+		return
+	}
+
+	p.Topics = n.topics
+
+	if len(n.attrs) == 0 {
+		p.Meta = n.meta
+	} else {
+		p.Meta = append(slices.Clip(n.meta), n.attrs...)
+	}
+
+	if n.name != "" {
+		p.Name = n.name
+	}
+}
+
+// enrich reads the display name, description, engineering units, eu range and browse path of the nodes
+// and caches them, so they are published as meta with every value of the node
+func (s *OpcServer) enrich(ctx context.Context, c *opcua.Client, nodes []Nodeid) {
+
+	if len(nodes) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(nodes))
+	ids := make([]*ua.NodeID, 0, len(nodes))
+
+	for _, n := range nodes {
+		nid, err := s.parseNodeID(n.Id)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, nid.String())
+		ids = append(ids, nid)
+	}
+
+	names := make([]string, len(ids))
+	attrs := make([][]handlers.Meta, len(ids))
+
+	if err := readDescriptions(ctx, c, ids, names, attrs); err != nil {
+		logging.Logger.Error(fmt.Sprintf("error reading attributes for enrichment: %s", err.Error()), "func", "enrich", "server", s.Name)
+		return
+	}
+
+	if err := readProperties(ctx, c, ids, attrs); err != nil {
+		logging.Logger.Error(fmt.Sprintf("error reading properties for enrichment: %s", err.Error()), "func", "enrich", "server", s.Name)
+	}
+
+	if err := readBrowsePaths(ctx, c, ids, attrs); err != nil {
+		logging.Logger.Error(fmt.Sprintf("error reading browse paths for enrichment: %s", err.Error()), "func", "enrich", "server", s.Name)
+	}
+
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+
+	for i, k := range keys {
+		if n, ok := s.nodes[k]; ok {
+			n.name = names[i]
+			n.attrs = attrs[i]
+		}
+	}
+
+	logging.Logger.Info(fmt.Sprintf("enriched %d nodes of server %s", len(keys), s.Name))
+}
+
+// readDescriptions reads the DisplayName and Description attributes of the nodes
+func readDescriptions(ctx context.Context, c *opcua.Client, ids []*ua.NodeID, names []string, attrs [][]handlers.Meta) error {
+
+	for i := 0; i < len(ids); i += browseChunk {
+		chunk := ids[i:min(i+browseChunk, len(ids))]
+
+		var rv []*ua.ReadValueID
+		for _, nid := range chunk {
+			rv = append(rv,
+				&ua.ReadValueID{NodeID: nid, AttributeID: ua.AttributeIDDisplayName},
+				&ua.ReadValueID{NodeID: nid, AttributeID: ua.AttributeIDDescription},
+			)
+		}
+
+		res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: rv})
+		if err != nil {
+			return err
+		}
+
+		for j := range chunk {
+			if 2*j+1 >= len(res.Results) {
+				break
+			}
+
+			if dn := localizedText(res.Results[2*j]); dn != "" {
+				names[i+j] = dn
+				attrs[i+j] = append(attrs[i+j], handlers.Meta{Key: "display_name", Value: dn})
+			}
+
+			if desc := localizedText(res.Results[2*j+1]); desc != "" {
+				attrs[i+j] = append(attrs[i+j], handlers.Meta{Key: "description", Value: desc})
+			}
+		}
+	}
+
+	return nil
+}
+
+// readProperties reads the EngineeringUnits and EURange properties of the nodes, if they exist
+func readProperties(ctx context.Context, c *opcua.Client, ids []*ua.NodeID, attrs [][]handlers.Meta) error {
+
+	props, err := browseEach(ctx, c, ids, ua.BrowseDirectionForward, id.HasProperty)
+	if err != nil {
+		return err
+	}
+
+	var owners []int
+	var rv []*ua.ReadValueID
+
+	for i, refs := range props {
+		for _, r := range refs {
+			if r.BrowseName == nil {
+				continue
+			}
+			if r.BrowseName.Name == "EngineeringUnits" || r.BrowseName.Name == "EURange" {
+				owners = append(owners, i)
+				rv = append(rv, &ua.ReadValueID{NodeID: r.NodeID.NodeID, AttributeID: ua.AttributeIDValue})
+			}
+		}
+	}
+
+	for i := 0; i < len(rv); i += browseChunk {
+		res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: rv[i:min(i+browseChunk, len(rv))]})
+		if err != nil {
+			return err
+		}
+
+		for j, r := range res.Results {
+			if r.Status != ua.StatusOK || r.Value == nil {
+				continue
+			}
+
+			eo, ok := r.Value.Value().(*ua.ExtensionObject)
+			if !ok {
+				continue
+			}
+
+			o := owners[i+j]
+
+			switch v := eo.Value.(type) {
+			case *ua.EUInformation:
+				if v.DisplayName != nil && v.DisplayName.Text != "" {
+					attrs[o] = append(attrs[o], handlers.Meta{Key: "engineering_units", Value: v.DisplayName.Text})
+				}
+			case *ua.Range:
+				attrs[o] = append(attrs[o], handlers.Meta{Key: "eu_range", Value: fmt.Sprintf("%v..%v", v.Low, v.High)})
+			}
+		}
+	}
+
+	return nil
+}
+
+// readBrowsePaths builds the browse path of the nodes by following the inverse hierarchical references up to the Objects folder
+func readBrowsePaths(ctx context.Context, c *opcua.Client, ids []*ua.NodeID, attrs [][]handlers.Meta) error {
+
+	paths := make([][]string, len(ids))
+	current := slices.Clone(ids)
+	open := make([]int, len(ids))
+	for i := range open {
+		open[i] = i
+	}
+
+	// the browse name of the node itself is not part of the inverse references
+	var rv []*ua.ReadValueID
+	for _, nid := range ids {
+		rv = append(rv, &ua.ReadValueID{NodeID: nid, AttributeID: ua.AttributeIDBrowseName})
+	}
+
+	for i := 0; i < len(rv); i += browseChunk {
+		res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: rv[i:min(i+browseChunk, len(rv))]})
+		if err != nil {
+			return err
+		}
+		for j, r := range res.Results {
+			if r.Status != ua.StatusOK || r.Value == nil {
+				continue
+			}
+			if qn, ok := r.Value.Value().(*ua.QualifiedName); ok {
+				paths[i+j] = []string{qn.Name}
+			}
+		}
+	}
+
+	for depth := 0; depth < maxBrowsePathDepth && len(open) > 0; depth++ {
+		parents, err := browseEach(ctx, c, current, ua.BrowseDirectionInverse, id.HierarchicalReferences)
+		if err != nil {
+			return err
+		}
+
+		var nextNodes []*ua.NodeID
+		var nextOpen []int
+
+		for j, refs := range parents {
+			o := open[j]
+			if len(refs) == 0 || refs[0].BrowseName == nil {
+				paths[o] = nil
+				continue
+			}
+
+			p := refs[0].NodeID.NodeID
+			paths[o] = append(paths[o], refs[0].BrowseName.Name)
+
+			if p.Namespace() == 0 && p.IntID() == id.ObjectsFolder {
+				continue
+			}
+
+			nextNodes = append(nextNodes, p)
+			nextOpen = append(nextOpen, o)
+		}
+
+		current, open = nextNodes, nextOpen
+	}
+
+	// paths which did not reach the Objects folder are incomplete and dropped
+	for _, o := range open {
+		paths[o] = nil
+	}
+
+	for i, p := range paths {
+		if len(p) == 0 {
+			continue
+		}
+		slices.Reverse(p)
+		attrs[i] = append(attrs[i], handlers.Meta{Key: "browse_path", Value: "/" + strings.Join(p, "/")})
+	}
+
+	return nil
+}
+
+func localizedText(r *ua.DataValue) string {
+
+	if r == nil || r.Status != ua.StatusOK || r.Value == nil {
+		return ""
+	}
+
+	if lt, ok := r.Value.Value().(*ua.LocalizedText); ok && lt != nil {
+		return lt.Text
+	}
+
+	return ""
+}
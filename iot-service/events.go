@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// defaultEventFields are selected if an event subscription does not configure any fields
+var defaultEventFields = []string{"EventId", "EventType", "SourceName", "Time", "Message", "Severity"}
+
+// EventSubscription monitors the events of a notifier node, by default the Server object
+type EventSubscription struct {
+	Name      string       `mapstructure:"name"`
+	Notifier  string       `mapstructure:"notifier"`
+	Interval  float64      `mapstructure:"sub_interval"`
+	QueueSize uint32       `mapstructure:"queue_size"`
+	Fields    []string     `mapstructure:"fields"`
+	Where     []EventWhere `mapstructure:"where"`
+	// Topics default to the topic of the exporter suffixed with -events
+	Topics []string `mapstructure:"topics"`
+}
+
+// EventWhere is a single condition of the where clause, all conditions have to match
+type EventWhere struct {
+	Field    string      `mapstructure:"field"`
+	Operator string      `mapstructure:"operator"`
+	Value    interface{} `mapstructure:"value"`
+}
+
+// CreateEventSubscription subscribes to the events of the notifier and publishes them until ctx is done
+func (s *OpcServer) CreateEventSubscription(ctx context.Context, c *opcua.Client, e EventSubscription) {
+
+	if e.Notifier == "" {
+		e.Notifier = ua.NewNumericNodeID(0, id.Server).String()
+	}
+
+	if len(e.Fields) == 0 {
+		e.Fields = defaultEventFields
+	}
+
+	if e.Name == "" {
+		e.Name = e.Notifier
+	}
+
+	nid, err := s.parseNodeID(e.Notifier)
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("invalid notifier of event subscription %s: %s", e.Name, err.Error()), "func", "CreateEventSubscription")
+		return
+	}
+
+	req, err := e.monitorRequest(nid)
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("invalid event subscription %s: %s", e.Name, err.Error()), "func", "CreateEventSubscription")
+		return
+	}
+
+	params := &opcua.SubscriptionParameters{Interval: time.Second}
+	if e.Interval > 0 {
+		params.Interval = time.Duration(e.Interval * float64(time.Second))
+	}
+
+	notifyCh := make(chan *opcua.PublishNotificationData, 100)
+
+	sub, err := c.Subscribe(ctx, params, notifyCh)
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("error while creating event subscription %s: %s", e.Name, err.Error()), "func", "CreateEventSubscription")
+		return
+	}
+	defer sub.Cancel(context.WithoutCancel(ctx))
+
+	res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, req)
+	if err == nil && res.Results[0].StatusCode != ua.StatusOK {
+		err = res.Results[0].StatusCode
+	}
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("error adding event item for %s: %s", e.Notifier, err.Error()), "func", "CreateEventSubscription")
+		return
+	}
+
+	logging.Logger.Info(fmt.Sprintf("successfully initialized event subscription %s on server %s with id:%d", e.Name, s.Name, sub.SubscriptionID))
+
+	s.conditionRefresh(ctx, c, sub.SubscriptionID, e.Name)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-notifyCh:
+			if n.Error != nil {
+				logging.Logger.Error(fmt.Sprintf("error with received event message: %s", n.Error.Error()), "func", "CreateEventSubscription")
+				continue
+			}
+
+			l, ok := n.Value.(*ua.EventNotificationList)
+			if !ok {
+				continue
+			}
+
+			for _, ev := range l.Events {
+				p := e.payload(ev)
+				if refreshEvent(p) {
+					continue
+				}
+				p.Id = s.stableID(nid)
+				s.publish(ctx, p)
+			}
+		}
+	}
+}
+
+// conditionRefresh asks the server to send the current state of all conditions to the subscription, so alarms which
+// were active before the subscription was created are published as well
+// Servers without alarms & conditions reject the call, which leaves the subscription untouched
+func (s *OpcServer) conditionRefresh(ctx context.Context, c *opcua.Client, subID uint32, name string) {
+
+	res, err := c.Call(ctx, &ua.CallMethodRequest{
+		ObjectID:       ua.NewNumericNodeID(0, id.ConditionType),
+		MethodID:       ua.NewNumericNodeID(0, id.ConditionType_ConditionRefresh),
+		InputArguments: []*ua.Variant{ua.MustVariant(subID)},
+	})
+	if err == nil && res.StatusCode != ua.StatusOK {
+		err = res.StatusCode
+	}
+	if err != nil {
+		logging.Logger.Warn(fmt.Sprintf("condition refresh of event subscription %s failed: %s", name, err.Error()), "func", "conditionRefresh", "server", s.Name)
+	}
+}
+
+// refreshEvent reports whether the payload is the start or end marker of a condition refresh, they can only be
+// recognized if the EventType is selected
+func refreshEvent(p handlers.Payload) bool {
+	fields, _ := p.Value.(map[string]interface{})
+
+	switch fields["EventType"] {
+	case ua.NewNumericNodeID(0, id.RefreshStartEventType).String(), ua.NewNumericNodeID(0, id.RefreshEndEventType).String():
+		return true
+	}
+	return false
+}
+
+// payload converts the selected fields of an event into a payload with datatype Event
+func (e *EventSubscription) payload(ev *ua.EventFieldList) handlers.Payload {
+
+	fields := make(map[string]interface{}, len(e.Fields))
+	for i, f := range ev.EventFields {
+		if i >= len(e.Fields) {
+			break
+		}
+		fields[e.Fields[i]] = eventFieldValue(f)
+	}
+
+	p := handlers.Payload{
+		Value:    fields,
+		TS:       time.Now(),
+		Name:     e.Name,
+		Id:       e.Notifier,
+		Datatype: handlers.DatatypeEvent,
+		Topics:   e.Topics,
+	}
+
+	if ts, ok := fields["Time"].(time.Time); ok && !ts.IsZero() {
+		p.TS = ts
+	}
+
+	if s, ok := fields["SourceName"].(string); ok && s != "" {
+		p.Name = s
+	}
+
+	return p
+}
+
+// monitorRequest builds the monitored item for the EventNotifier attribute of the notifier with the event filter
+func (e *EventSubscription) monitorRequest(nid *ua.NodeID) (*ua.MonitoredItemCreateRequest, error) {
+
+	filter := &ua.EventFilter{WhereClause: &ua.ContentFilter{}}
+
+	for _, f := range e.Fields {
+		filter.SelectClauses = append(filter.SelectClauses, eventOperand(f))
+	}
+
+	where, err := whereElements(e.Where)
+	if err != nil {
+		return nil, err
+	}
+	filter.WhereClause.Elements = where
+
+	qs := e.QueueSize
+	if qs == 0 {
+		qs = 100
+	}
+
+	return &ua.MonitoredItemCreateRequest{
+		ItemToMonitor: &ua.ReadValueID{
+			NodeID:       nid,
+			AttributeID:  ua.AttributeIDEventNotifier,
+			DataEncoding: &ua.QualifiedName{},
+		},
+		MonitoringMode: ua.MonitoringModeReporting,
+		RequestedParameters: &ua.MonitoringParameters{
+			ClientHandle:  1,
+			DiscardOldest: true,
+			Filter:        ua.NewExtensionObject(filter),
+			QueueSize:     qs,
+		},
+	}, nil
+}
+
+// eventOperand selects a field of the BaseEventType, nested fields like ActiveState/Id are separated by a slash
+// ConditionId selects the node id of the condition, which correlates the events of an alarm with its acknowledgement
+func eventOperand(field string) *ua.SimpleAttributeOperand {
+
+	if field == "ConditionId" {
+		return &ua.SimpleAttributeOperand{
+			TypeDefinitionID: ua.NewNumericNodeID(0, id.ConditionType),
+			AttributeID:      ua.AttributeIDNodeID,
+		}
+	}
+
+	var path []*ua.QualifiedName
+	for _, name := range strings.Split(field, "/") {
+		path = append(path, &ua.QualifiedName{NamespaceIndex: 0, Name: name})
+	}
+
+	return &ua.SimpleAttributeOperand{
+		TypeDefinitionID: ua.NewNumericNodeID(0, id.BaseEventType),
+		BrowsePath:       path,
+		AttributeID:      ua.AttributeIDValue,
+	}
+}
+
+// whereElements builds the content filter for all conditions combined with And
+// The And elements come first, so element 0 is always the root of the filter
+func whereElements(conds []EventWhere) ([]*ua.ContentFilterElement, error) {
+
+	n := len(conds)
+	if n == 0 {
+		return nil, nil
+	}
+
+	elems := make([]*ua.ContentFilterElement, 0, 2*n-1)
+
+	for i := 0; i < n-1; i++ {
+		next := uint32(i + 1)
+		if i == n-2 {
+			next = uint32(2*n - 2)
+		}
+		elems = append(elems, &ua.ContentFilterElement{
+			FilterOperator: ua.FilterOperatorAnd,
+			FilterOperands: []*ua.ExtensionObject{
+				ua.NewExtensionObject(&ua.ElementOperand{Index: uint32(n - 1 + i)}),
+				ua.NewExtensionObject(&ua.ElementOperand{Index: next}),
+			},
+		})
+	}
+
+	for _, c := range conds {
+		el, err := c.element()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, el)
+	}
+
+	return elems, nil
+}
+
+func (w *EventWhere) element() (*ua.ContentFilterElement, error) {
+
+	if w.Operator == "oftype" {
+		nid, err := ua.ParseNodeID(fmt.Sprint(w.Value))
+		if err != nil {
+			return nil, err
+		}
+		return &ua.ContentFilterElement{
+			FilterOperator: ua.FilterOperatorOfType,
+			FilterOperands: []*ua.ExtensionObject{ua.NewExtensionObject(&ua.LiteralOperand{Value: ua.MustVariant(nid)})},
+		}, nil
+	}
+
+	var op ua.FilterOperator
+
+	switch w.Operator {
+	case "", "eq":
+		op = ua.FilterOperatorEquals
+	case "gt":
+		op = ua.FilterOperatorGreaterThan
+	case "gte":
+		op = ua.FilterOperatorGreaterThanOrEqual
+	case "lt":
+		op = ua.FilterOperatorLessThan
+	case "lte":
+		op = ua.FilterOperatorLessThanOrEqual
+	case "like":
+		op = ua.FilterOperatorLike
+	default:
+		return nil, fmt.Errorf("unknown where operator %q", w.Operator)
+	}
+
+	if w.Field == "" {
+		return nil, fmt.Errorf("where condition with operator %s requires a field", op)
+	}
+
+	v := w.Value
+	if i, ok := v.(int); ok {
+		v = int64(i)
+	}
+
+	lit, err := ua.NewVariant(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for field %s: %w", w.Field, err)
+	}
+
+	return &ua.ContentFilterElement{
+		FilterOperator: op,
+		FilterOperands: []*ua.ExtensionObject{
+			ua.NewExtensionObject(eventOperand(w.Field)),
+			ua.NewExtensionObject(&ua.LiteralOperand{Value: lit}),
+		},
+	}, nil
+}
+
+// eventFieldValue converts opc ua structures of an event field into plain values
+func eventFieldValue(v *ua.Variant) interface{} {
+
+	if v == nil {
+		return nil
+	}
+
+	switch t := v.Value().(type) {
+	case *ua.LocalizedText:
+		return t.Text
+	case *ua.NodeID:
+		return t.String()
+	case *ua.QualifiedName:
+		return t.Name
+	case []byte:
+		return hex.EncodeToString(t)
+	default:
+		return t
+	}
+}
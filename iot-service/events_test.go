@@ -0,0 +1,50 @@
+package main
+
+import (
+	"gualogger/handlers"
+	"testing"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestEventOperand(t *testing.T) {
+
+	op := eventOperand("ActiveState/Id")
+	if len(op.BrowsePath) != 2 || op.AttributeID != ua.AttributeIDValue || op.TypeDefinitionID.IntID() != id.BaseEventType {
+		t.Fatalf("unexpected operand for a nested field: %+v", op)
+	}
+
+	// the condition id is the node id of the ConditionType instance itself
+	op = eventOperand("ConditionId")
+	if len(op.BrowsePath) != 0 || op.AttributeID != ua.AttributeIDNodeID || op.TypeDefinitionID.IntID() != id.ConditionType {
+		t.Fatalf("unexpected operand for ConditionId: %+v", op)
+	}
+}
+
+func TestRefreshEvent(t *testing.T) {
+
+	e := &EventSubscription{Name: "alarms", Fields: []string{"EventType", "ConditionId"}}
+
+	for _, tc := range []struct {
+		eventType uint32
+		want      bool
+	}{
+		{eventType: id.RefreshStartEventType, want: true},
+		{eventType: id.RefreshEndEventType, want: true},
+		{eventType: id.AlarmConditionType},
+	} {
+		ev := &ua.EventFieldList{EventFields: []*ua.Variant{
+			ua.MustVariant(ua.NewNumericNodeID(0, tc.eventType)),
+			ua.MustVariant(ua.NewStringNodeID(2, "Tank.HighLevel")),
+		}}
+
+		p := e.payload(ev)
+		if got := refreshEvent(p); got != tc.want {
+			t.Errorf("event type %d: got %t, want %t", tc.eventType, got, tc.want)
+		}
+		if p.Datatype != handlers.DatatypeEvent {
+			t.Errorf("unexpected datatype %s", p.Datatype)
+		}
+	}
+}
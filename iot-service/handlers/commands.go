@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gualogger/logging"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Commands configures the consumer of write or call requests, it is disabled as long as no topic is set
+type Commands struct {
+	Topic string `mapstructure:"topic"`
+	// ReplyTopic receives one reply per request, defaults to the request topic suffixed with -ack
+	ReplyTopic string `mapstructure:"reply_topic"`
+	// Group is the consumer group of the connector, defaults to geist-<connector>-<topic>. Every connector needs a
+	// group of its own, requests for servers of other connectors are skipped
+	Group string `mapstructure:"group"`
+	// MaxAge drops requests which are older than MaxAge seconds by their record timestamp, defaults to 60
+	MaxAge int `mapstructure:"max_age"`
+}
+
+// Enabled reports whether requests are consumed
+func (c *Commands) Enabled() bool {
+	return c.Topic != ""
+}
+
+func (c *Commands) replyTopic() string {
+	if c.ReplyTopic != "" {
+		return c.ReplyTopic
+	}
+	return c.Topic + "-ack"
+}
+
+func (c *Commands) group(connector string) string {
+	if c.Group != "" {
+		return c.Group
+	}
+	return "geist-" + connector + "-" + c.Topic
+}
+
+func (c *Commands) maxAge() time.Duration {
+	if c.MaxAge > 0 {
+		return time.Duration(c.MaxAge) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// WriteRequest asks the connector to write a value to a node of an opcua server
+// Datatype is the expected datatype of the node, e.g. f64 or Double. Server may be omitted if only one server is configured
+type WriteRequest struct {
+	CorrelationID string      `json:"correlation_id"`
+	Server        string      `json:"server,omitempty"`
+	NodeID        string      `json:"node_id"`
+	Value         interface{} `json:"value"`
+	Datatype      string      `json:"datatype"`
+}
+
+// WriteAck is the reply to a write request, StatusCode is the opcua status code of the write
+// Error is set if the request was rejected before it reached the server
+type WriteAck struct {
+	CorrelationID string    `json:"correlation_id"`
+	Server        string    `json:"server,omitempty"`
+	NodeID        string    `json:"node_id"`
+	StatusCode    uint32    `json:"status_code"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	TS            time.Time `json:"ts"`
+}
+
+// CallRequest asks the connector to call a method of an object node, the arguments are validated against the
+// InputArguments of the method. The datatype of an argument may be omitted, it defaults to the declared datatype
+type CallRequest struct {
+	CorrelationID string     `json:"correlation_id"`
+	Server        string     `json:"server,omitempty"`
+	ObjectID      string     `json:"object_id"`
+	MethodID      string     `json:"method_id"`
+	Arguments     []Argument `json:"arguments"`
+}
+
+// Argument is a typed input or output argument of a method call, arrays are given as json arrays
+type Argument struct {
+	Name     string      `json:"name,omitempty"`
+	Datatype string      `json:"datatype,omitempty"`
+	Value    interface{} `json:"value"`
+}
+
+// CallReply is the reply to a call request, InputResults holds the status of every input argument if the server
+// rejected one of them. Error is set if the request was rejected before it reached the server
+type CallReply struct {
+	CorrelationID string     `json:"correlation_id"`
+	Server        string     `json:"server,omitempty"`
+	ObjectID      string     `json:"object_id"`
+	MethodID      string     `json:"method_id"`
+	StatusCode    uint32     `json:"status_code"`
+	Status        string     `json:"status"`
+	InputResults  []string   `json:"input_results,omitempty"`
+	Outputs       []Argument `json:"outputs,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	TS            time.Time  `json:"ts"`
+}
+
+// ConsumeCommands consumes write requests until ctx is done, write performs the request and its acknowledgement is
+// published to the reply topic. write returns false for requests addressed to a server of another connector, they
+// are skipped without a reply
+func (r *Redpanda) ConsumeCommands(ctx context.Context, connector string, write func(context.Context, WriteRequest) (WriteAck, bool)) error {
+	return r.consume(ctx, r.Commands, connector, "write requests", func(ctx context.Context, rec *kgo.Record) interface{} {
+
+		var req WriteRequest
+
+		if err := decodeRequest(rec, &req); err != nil {
+			return WriteAck{CorrelationID: string(rec.Key), Error: fmt.Sprintf("invalid write request: %s", err.Error()), TS: time.Now()}
+		}
+
+		if req.CorrelationID == "" {
+			req.CorrelationID = string(rec.Key)
+		}
+
+		ack, ok := write(ctx, req)
+		if !ok {
+			return nil
+		}
+
+		if ack.Error != "" {
+			logging.Logger.Warn(fmt.Sprintf("write request %s to node %s rejected: %s", req.CorrelationID, req.NodeID, ack.Error), "func", "ConsumeCommands")
+		}
+
+		return ack
+	})
+}
+
+// ConsumeMethods consumes call requests until ctx is done, call performs the request and its reply is published to
+// the reply topic. call returns false for requests addressed to a server of another connector, they are skipped
+// without a reply. Requests are delivered at least once: a connector which crashes after the call and before the
+// commit calls the method again after the restart, unless the request has expired by then. Requesters of methods
+// which are not idempotent have to expect a second reply with the same correlation id
+func (r *Redpanda) ConsumeMethods(ctx context.Context, connector string, call func(context.Context, CallRequest) (CallReply, bool)) error {
+	return r.consume(ctx, r.Methods, connector, "call requests", func(ctx context.Context, rec *kgo.Record) interface{} {
+
+		var req CallRequest
+
+		if err := decodeRequest(rec, &req); err != nil {
+			return CallReply{CorrelationID: string(rec.Key), Error: fmt.Sprintf("invalid call request: %s", err.Error()), TS: time.Now()}
+		}
+
+		if req.CorrelationID == "" {
+			req.CorrelationID = string(rec.Key)
+		}
+
+		reply, ok := call(ctx, req)
+		if !ok {
+			return nil
+		}
+
+		if reply.Error != "" {
+			logging.Logger.Warn(fmt.Sprintf("call request %s of method %s rejected: %s", req.CorrelationID, req.MethodID, reply.Error), "func", "ConsumeMethods")
+		}
+
+		return reply
+	})
+}
+
+// decodeRequest decodes a json request, numbers are kept as json.Number so 64 bit integers keep their precision
+func decodeRequest(rec *kgo.Record, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(rec.Value))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// consume handles the requests of the topic until ctx is done and publishes the reply of every request keyed with
+// the key of the request, handle returns nil if there is no reply. A new group starts at the end of the topic and
+// requests older than the max age are dropped, so stale requests are not performed after a downtime. Offsets are
+// committed after the reply was published, a request which was handled shortly before a crash is handled again
+func (r *Redpanda) consume(ctx context.Context, c Commands, connector string, what string, handle func(context.Context, *kgo.Record) interface{}) error {
+
+	opts := append(r.clientOpts(),
+		kgo.ConsumeTopics(c.Topic),
+		kgo.ConsumerGroup(c.group(connector)),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()),
+		kgo.DisableAutoCommit(),
+	)
+
+	client, err := kgo.NewClient(opts...)
+
+	if err != nil {
+		return fmt.Errorf("error creating consumer of %s: %w", what, err)
+	}
+
+	defer client.Close()
+
+	logging.Logger.Info(fmt.Sprintf("consuming %s from topic %s with group %s - replies are sent to %s", what, c.Topic, c.group(connector), c.replyTopic()))
+
+	for {
+		fetches := client.PollFetches(ctx)
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		fetches.EachError(func(topic string, partition int32, err error) {
+			logging.Logger.Warn(fmt.Sprintf("error fetching %s from %s/%d: %s", what, topic, partition, err.Error()), "func", "consume")
+		})
+
+		var done []*kgo.Record
+
+		fetches.EachRecord(func(rec *kgo.Record) {
+			if age := time.Since(rec.Timestamp); age > c.maxAge() {
+				logging.Logger.Warn(fmt.Sprintf("dropped %s %s from %s/%d: request is %s old - max age: %s", what, string(rec.Key), rec.Topic, rec.Partition, age.Round(time.Second), c.maxAge()), "func", "consume")
+				done = append(done, rec)
+				return
+			}
+
+			res := handle(ctx, rec)
+			if res == nil {
+				done = append(done, rec)
+				return
+			}
+
+			b, err := json.Marshal(res)
+			if err != nil {
+				logging.Logger.Error(fmt.Sprintf("failed to encode reply: %s", err.Error()), "func", "consume")
+				return
+			}
+
+			reply := &kgo.Record{Topic: c.replyTopic(), Key: rec.Key, Value: b}
+
+			if err := client.ProduceSync(ctx, reply).FirstErr(); err != nil {
+				logging.Logger.Error(fmt.Sprintf("failed to publish reply to %s: %s", c.replyTopic(), err.Error()), "func", "consume")
+				return
+			}
+
+			done = append(done, rec)
+		})
+
+		if len(done) > 0 {
+			if err := client.CommitRecords(ctx, done...); err != nil && ctx.Err() == nil {
+				logging.Logger.Warn(fmt.Sprintf("failed to commit %s: %s", what, err.Error()), "func", "consume")
+			}
+		}
+	}
+}
@@ -0,0 +1,655 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"gualogger/logging"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT struct holds the configuration for the MQTT exporter
+type MQTT struct {
+	Broker          string `mapstructure:"broker"`
+	ClientID        string `mapstructure:"client_id"`
+	ProtocolVersion int    `mapstructure:"protocol_version"`
+	Topic           string `mapstructure:"topic"`
+	QoS             byte   `mapstructure:"qos"`
+	Retain          bool   `mapstructure:"retain"`
+	KeepAlive       int    `mapstructure:"keep_alive"`
+	Auth            struct {
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+	} `mapstructure:"auth"`
+	TLS struct {
+		InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+	} `mapstructure:"tls"`
+	Sparkplug Sparkplug `mapstructure:"sparkplug"`
+
+	conn mqttConn
+
+	mu       sync.Mutex
+	bdSeq    uint64
+	devices  map[string]*spDevice
+	nodeUp   bool
+	shutdown bool
+
+	// spMu serializes the sparkplug messages, so they are published in the order of their sequence numbers
+	spMu sync.Mutex
+	seq  uint64
+}
+
+// mqttConn abstracts the client libraries for MQTT 3.1.1 and MQTT 5
+type mqttConn interface {
+	publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error
+	subscribe(ctx context.Context, topic string, qos byte, cb func(topic string, payload []byte)) error
+	connected() bool
+	close(ctx context.Context)
+}
+
+// Initialize connects to the MQTT broker on the first call. Later calls only check the existing connection: both
+// clients reconnect on their own, and replacing the connection would reset the sparkplug session with a new NBIRTH
+func (m *MQTT) Initialize(ctx context.Context) error {
+
+	m.mu.Lock()
+	exists := m.conn != nil
+	m.mu.Unlock()
+
+	if exists {
+		return m.Ping(ctx)
+	}
+
+	if m.Broker == "" {
+		return fmt.Errorf("no mqtt broker configured")
+	}
+
+	if m.ClientID == "" {
+		h, _ := os.Hostname()
+		m.ClientID = "geist-" + h
+	}
+
+	if m.KeepAlive <= 0 {
+		m.KeepAlive = 30
+	}
+
+	if m.Topic == "" {
+		m.Topic = "geist"
+	}
+
+	if m.Sparkplug.Enabled {
+		if m.Sparkplug.GroupID == "" || m.Sparkplug.EdgeNodeID == "" {
+			return fmt.Errorf("sparkplug requires group_id and edge_node_id")
+		}
+	}
+
+	m.mu.Lock()
+	if m.devices == nil {
+		m.devices = make(map[string]*spDevice)
+	}
+	m.shutdown = false
+	m.mu.Unlock()
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var conn mqttConn
+	var err error
+
+	switch m.ProtocolVersion {
+	case 5:
+		conn, err = m.connectV5(cctx)
+	case 0, 3, 4:
+		conn, err = m.connectV311(cctx)
+	default:
+		return fmt.Errorf("unsupported mqtt protocol version %d", m.ProtocolVersion)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.conn = conn
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Publish sends the payload as json to all of its topics, or as sparkplug DDATA/DBIRTH message if sparkplug is enabled
+func (m *MQTT) Publish(ctx context.Context, p Payload) error {
+
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("mqtt client is not initialized")
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if m.Sparkplug.Enabled {
+		return m.publishSparkplug(pctx, conn, p)
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %v", err)
+	}
+
+	for _, t := range p.topics(m.Topic) {
+		if err := conn.publish(pctx, t, m.QoS, m.Retain, b); err != nil {
+			return fmt.Errorf("mqtt publish failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (m *MQTT) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn == nil {
+		return fmt.Errorf("mqtt client is not initialized")
+	}
+
+	if !m.conn.connected() {
+		return fmt.Errorf("mqtt client is not connected to %s", m.Broker)
+	}
+
+	return nil
+}
+
+// Shutdown publishes the NDEATH certificate if sparkplug is enabled and disconnects from the broker
+func (m *MQTT) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	conn := m.conn
+	m.conn = nil
+	m.shutdown = true
+	death := m.deathPayload()
+	m.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	if m.Sparkplug.Enabled && conn.connected() {
+		if err := conn.publish(ctx, m.Sparkplug.spTopic("NDEATH", ""), 1, false, death); err != nil {
+			logging.Logger.Warn(fmt.Sprintf("failed to publish sparkplug NDEATH: %s", err.Error()), "func", "Shutdown")
+		}
+	}
+
+	conn.close(ctx)
+	return nil
+}
+
+func (m *MQTT) tlsConfig() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: m.TLS.InsecureSkipVerify}
+}
+
+// nextDeath increments the birth/death sequence number and returns the matching NDEATH payload
+// It has to be called before every connection attempt, the following NBIRTH carries the same bdSeq
+func (m *MQTT) nextDeath() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.nodeUp {
+		m.bdSeq = (m.bdSeq + 1) % 256
+		m.nodeUp = false
+	}
+
+	return m.deathPayload()
+}
+
+func (m *MQTT) deathPayload() []byte {
+	return encodeSparkplugPayload(time.Now(), -1, []spMetric{{name: "bdSeq", ts: time.Now(), datatype: spInt64, value: int64(m.bdSeq)}})
+}
+
+// onConnect publishes the NBIRTH and all known DBIRTH messages and subscribes to node commands
+func (m *MQTT) onConnect(conn mqttConn) {
+
+	m.mu.Lock()
+	if m.shutdown {
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := m.rebirth(ctx, conn); err != nil {
+		logging.Logger.Error(fmt.Sprintf("failed to publish sparkplug birth certificates: %s", err.Error()), "func", "onConnect")
+		return
+	}
+
+	if err := conn.subscribe(ctx, m.Sparkplug.spTopic("NCMD", ""), 1, m.handleCommand); err != nil {
+		logging.Logger.Error(fmt.Sprintf("failed to subscribe to sparkplug node commands: %s", err.Error()), "func", "onConnect")
+	}
+}
+
+func (m *MQTT) rebirth(ctx context.Context, conn mqttConn) error {
+	m.spMu.Lock()
+	defer m.spMu.Unlock()
+
+	m.seq = 0
+
+	m.mu.Lock()
+	m.nodeUp = true
+	bdSeq := m.bdSeq
+
+	devices := make([]string, 0, len(m.devices))
+	for d, dev := range m.devices {
+		clear(dev.born)
+		devices = append(devices, d)
+	}
+	m.mu.Unlock()
+
+	birth := encodeSparkplugPayload(time.Now(), int(m.seq), []spMetric{
+		{name: "bdSeq", ts: time.Now(), datatype: spInt64, value: int64(bdSeq)},
+		{name: spRebirthMetric, ts: time.Now(), datatype: spBoolean, value: false},
+	})
+
+	if err := conn.publish(ctx, m.Sparkplug.spTopic("NBIRTH", ""), 0, false, birth); err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		if err := m.deviceBirth(ctx, conn, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MQTT) handleCommand(topic string, payload []byte) {
+
+	metrics, err := decodeSparkplugMetrics(payload)
+
+	if err != nil {
+		logging.Logger.Warn(fmt.Sprintf("received invalid sparkplug command on %s: %s", topic, err.Error()), "func", "handleCommand")
+		return
+	}
+
+	if !metrics[spRebirthMetric] {
+		return
+	}
+
+	logging.Logger.Info("received sparkplug rebirth request", "func", "handleCommand")
+
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+
+	if conn != nil {
+		go m.onConnect(conn)
+	}
+}
+
+// publishSparkplug sends a DDATA message. Sparkplug requires every metric to be announced in the birth certificate,
+// so values of metrics which are not born yet are queued for the birth window, the DBIRTH announces all of them at
+// once and the queued values follow as DDATA
+func (m *MQTT) publishSparkplug(ctx context.Context, conn mqttConn, p Payload) error {
+
+	device := m.Sparkplug.deviceFor(p)
+	metric := metricFromPayload(p)
+
+	m.spMu.Lock()
+	defer m.spMu.Unlock()
+
+	m.mu.Lock()
+	dev, ok := m.devices[device]
+	if !ok {
+		dev = &spDevice{metrics: make(map[string]spMetric), born: make(map[string]bool)}
+		m.devices[device] = dev
+	}
+
+	born := dev.born[metric.name]
+
+	if !born {
+		if len(dev.queued) >= spMaxQueued {
+			m.mu.Unlock()
+			return fmt.Errorf("too many values waiting for the DBIRTH of device %s", device)
+		}
+		dev.queued = append(dev.queued, metric)
+
+		if !dev.pending {
+			dev.pending = true
+			time.AfterFunc(m.Sparkplug.birthWindow(), func() { m.delayedBirth(device) })
+		}
+	}
+
+	dev.metrics[metric.name] = metric
+	m.mu.Unlock()
+
+	if !born {
+		return nil
+	}
+
+	// the display name is only part of the DBIRTH
+	metric.displayName = ""
+	msg := encodeSparkplugPayload(time.Now(), m.nextSeq(), []spMetric{metric})
+
+	return conn.publish(ctx, m.Sparkplug.spTopic("DDATA", device), 0, false, msg)
+}
+
+// delayedBirth sends the DBIRTH at the end of the birth window of the device, it is skipped if the device was born
+// by a rebirth in the meantime or the broker is not connected, the next connect sends it anyway
+func (m *MQTT) delayedBirth(device string) {
+
+	m.spMu.Lock()
+	defer m.spMu.Unlock()
+
+	m.mu.Lock()
+	conn := m.conn
+	dev := m.devices[device]
+	dev.pending = false
+	unborn := len(dev.born) < len(dev.metrics) || len(dev.queued) > 0
+	m.mu.Unlock()
+
+	if conn == nil || !unborn {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := m.deviceBirth(ctx, conn, device); err != nil {
+		logging.Logger.Error(fmt.Sprintf("failed to publish sparkplug DBIRTH of device %s: %s", device, err.Error()), "func", "delayedBirth")
+	}
+}
+
+// deviceBirth publishes the DBIRTH with all known metrics of the device followed by the queued values, spMu has to
+// be held. The DBIRTH carries the oldest queued value of a metric, so no value is skipped
+func (m *MQTT) deviceBirth(ctx context.Context, conn mqttConn, device string) error {
+
+	m.mu.Lock()
+	dev := m.devices[device]
+	queued := dev.queued
+
+	first := make(map[string]int, len(queued))
+	for i, mt := range queued {
+		if _, ok := first[mt.name]; !ok {
+			first[mt.name] = i
+		}
+	}
+
+	metrics := make([]spMetric, 0, len(dev.metrics))
+	for name, mt := range dev.metrics {
+		if i, ok := first[name]; ok {
+			mt = queued[i]
+		}
+		metrics = append(metrics, mt)
+	}
+	m.mu.Unlock()
+
+	msg := encodeSparkplugPayload(time.Now(), m.nextSeq(), metrics)
+
+	if err := conn.publish(ctx, m.Sparkplug.spTopic("DBIRTH", device), 0, false, msg); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	for _, mt := range metrics {
+		dev.born[mt.name] = true
+	}
+	m.mu.Unlock()
+
+	for i, mt := range queued {
+		if first[mt.name] == i {
+			continue
+		}
+
+		mt.displayName = ""
+		msg := encodeSparkplugPayload(time.Now(), m.nextSeq(), []spMetric{mt})
+
+		if err := conn.publish(ctx, m.Sparkplug.spTopic("DDATA", device), 0, false, msg); err != nil {
+			// the values not sent yet are kept for the next birth, no values are queued meanwhile as spMu is held
+			m.mu.Lock()
+			dev.queued = queued[i:]
+			m.mu.Unlock()
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	dev.queued = nil
+	m.mu.Unlock()
+
+	return nil
+}
+
+// nextSeq returns the sequence number of the next sparkplug message, spMu has to be held
+func (m *MQTT) nextSeq() int {
+	m.seq = (m.seq + 1) % 256
+	return int(m.seq)
+}
+
+// v311Conn implements mqttConn for MQTT 3.1.1 using the paho.mqtt.golang client
+type v311Conn struct {
+	client mqtt.Client
+}
+
+func (m *MQTT) connectV311(ctx context.Context) (mqttConn, error) {
+
+	conn := new(v311Conn)
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.Broker).
+		SetClientID(m.ClientID).
+		SetProtocolVersion(4).
+		SetKeepAlive(time.Duration(m.KeepAlive) * time.Second).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(30 * time.Second).
+		SetTLSConfig(m.tlsConfig())
+
+	if m.Auth.Username != "" {
+		opts.SetUsername(m.Auth.Username)
+		opts.SetPassword(m.Auth.Password)
+	}
+
+	if m.Sparkplug.Enabled {
+		opts.SetBinaryWill(m.Sparkplug.spTopic("NDEATH", ""), m.nextDeath(), 1, false)
+		opts.SetReconnectingHandler(func(_ mqtt.Client, o *mqtt.ClientOptions) {
+			o.SetBinaryWill(m.Sparkplug.spTopic("NDEATH", ""), m.nextDeath(), 1, false)
+		})
+		opts.SetOnConnectHandler(func(mqtt.Client) {
+			go m.onConnect(conn)
+		})
+	}
+
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		logging.Logger.Warn(fmt.Sprintf("lost connection to mqtt broker: %s", err.Error()), "func", "connectV311")
+	})
+
+	conn.client = mqtt.NewClient(opts)
+	t := conn.client.Connect()
+
+	select {
+	case <-t.Done():
+	case <-ctx.Done():
+		conn.client.Disconnect(0)
+		return nil, ctx.Err()
+	}
+
+	if err := t.Error(); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (c *v311Conn) publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	t := c.client.Publish(topic, qos, retain, payload)
+
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *v311Conn) subscribe(ctx context.Context, topic string, qos byte, cb func(topic string, payload []byte)) error {
+	t := c.client.Subscribe(topic, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		cb(msg.Topic(), msg.Payload())
+	})
+
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *v311Conn) connected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *v311Conn) close(ctx context.Context) {
+	c.client.Disconnect(250)
+}
+
+// v5Conn implements mqttConn for MQTT 5 using the paho.golang autopaho connection manager
+type v5Conn struct {
+	cm     *autopaho.ConnectionManager
+	cancel context.CancelFunc
+
+	mu       sync.RWMutex
+	up       bool
+	handlers map[string]func(topic string, payload []byte)
+}
+
+func (m *MQTT) connectV5(ctx context.Context) (mqttConn, error) {
+
+	u, err := url.Parse(m.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &v5Conn{handlers: make(map[string]func(string, []byte))}
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		TlsCfg:                        m.tlsConfig(),
+		KeepAlive:                     uint16(m.KeepAlive),
+		CleanStartOnInitialConnection: true,
+		ConnectUsername:               m.Auth.Username,
+		ConnectPassword:               []byte(m.Auth.Password),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			c.setUp(cm, true)
+			if m.Sparkplug.Enabled {
+				go m.onConnect(c)
+			}
+		},
+		OnConnectionDown: func() bool {
+			c.setUp(nil, false)
+			logging.Logger.Warn("lost connection to mqtt broker", "func", "connectV5")
+			return true
+		},
+		OnConnectError: func(err error) {
+			logging.Logger.Warn(fmt.Sprintf("failed to connect to mqtt broker: %s", err.Error()), "func", "connectV5")
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: m.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					c.mu.RLock()
+					cb, ok := c.handlers[pr.Packet.Topic]
+					c.mu.RUnlock()
+					if ok {
+						cb(pr.Packet.Topic, pr.Packet.Payload)
+					}
+					return ok, nil
+				},
+			},
+		},
+	}
+
+	if m.Sparkplug.Enabled {
+		cfg.ConnectPacketBuilder = func(cp *paho.Connect, _ *url.URL) (*paho.Connect, error) {
+			cp.WillMessage = &paho.WillMessage{Topic: m.Sparkplug.spTopic("NDEATH", ""), QoS: 1, Payload: m.nextDeath()}
+			cp.WillProperties = &paho.WillProperties{}
+			return cp, nil
+		}
+	}
+
+	// the connection manager lives until close is called, not only until the connect timeout
+	cmctx, cancel := context.WithCancel(context.Background())
+
+	cm, err := autopaho.NewConnection(cmctx, cfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cm = cm
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	if err := cm.AwaitConnection(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// setUp tracks the connection state, the connection manager is passed in since the first
+// connection can be established before NewConnection returned
+func (c *v5Conn) setUp(cm *autopaho.ConnectionManager, up bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cm != nil {
+		c.cm = cm
+	}
+	c.up = up
+}
+
+func (c *v5Conn) manager() *autopaho.ConnectionManager {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cm
+}
+
+func (c *v5Conn) publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	_, err := c.manager().Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retain, Payload: payload})
+	return err
+}
+
+func (c *v5Conn) subscribe(ctx context.Context, topic string, qos byte, cb func(topic string, payload []byte)) error {
+	c.mu.Lock()
+	c.handlers[topic] = cb
+	c.mu.Unlock()
+
+	_, err := c.manager().Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}}})
+	return err
+}
+
+func (c *v5Conn) connected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.up
+}
+
+func (c *v5Conn) close(ctx context.Context) {
+	dctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	c.manager().Disconnect(dctx)
+	c.cancel()
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gualogger/logging"
+	"net"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+type received struct {
+	topic   string
+	payload []byte
+}
+
+// startBroker runs an embedded MQTT broker and returns its address and all messages published to it
+func startBroker(t *testing.T) (string, <-chan received) {
+	t.Helper()
+
+	logging.InitLogger("ERROR")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv := mochi.New(&mochi.Options{InlineClient: true})
+
+	if err := srv.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.AddListener(listeners.NewTCP(listeners.Config{ID: "t1", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make(chan received, 100)
+
+	if err := srv.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		msgs <- received{topic: pk.TopicName, payload: pk.Payload}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve()
+	t.Cleanup(func() { srv.Close() })
+
+	return addr, msgs
+}
+
+func expectMessage(t *testing.T, msgs <-chan received, topic string) received {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case m := <-msgs:
+			if m.topic == topic {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("no message received on topic %s", topic)
+		}
+	}
+}
+
+func TestMQTTPublishJSON(t *testing.T) {
+	for _, v := range []int{4, 5} {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			addr, msgs := startBroker(t)
+			ctx := context.Background()
+
+			m := &MQTT{Broker: "tcp://" + addr, ProtocolVersion: v, Topic: "geist", QoS: 1}
+
+			if err := m.Initialize(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Shutdown(ctx)
+
+			if err := m.Ping(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			p := Payload{Value: 42.5, TS: time.Now(), Name: "Temperature", Id: "ns=2;s=Temperature", Datatype: "f64"}
+
+			if err := m.Publish(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := expectMessage(t, msgs, "geist")
+
+			var got Payload
+			if err := json.Unmarshal(rec.payload, &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Id != p.Id || got.Value != p.Value {
+				t.Fatalf("unexpected payload %+v", got)
+			}
+		})
+	}
+}
+
+func TestMQTTSparkplug(t *testing.T) {
+	for _, v := range []int{4, 5} {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			addr, msgs := startBroker(t)
+			ctx := context.Background()
+
+			m := &MQTT{
+				Broker:          "tcp://" + addr,
+				ProtocolVersion: v,
+				Sparkplug:       Sparkplug{Enabled: true, GroupID: "plant", EdgeNodeID: "geist", BirthWindowMs: 100},
+			}
+
+			if err := m.Initialize(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			birth := expectMessage(t, msgs, "spBv1.0/plant/NBIRTH/geist")
+			metrics, err := decodeSparkplugMetrics(birth.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := metrics["bdSeq"]; !ok {
+				t.Fatalf("NBIRTH without bdSeq: %v", metrics)
+			}
+
+			// the supervisor initializes the exporter again after a failed ping, the session has to be kept
+			conn := m.conn
+			if err := m.Initialize(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if m.conn != conn {
+				t.Fatal("Initialize replaced the existing connection")
+			}
+
+			// both metrics of the birth window are announced in a single DBIRTH
+			// metrics are named after the node id, the display names may be the same
+			p := Payload{Value: true, TS: time.Now(), Name: "Running", Id: "ns=2;s=Line1.Running", Server: "plc1", Datatype: "Bool"}
+			alarm := Payload{Value: true, TS: time.Now(), Name: "Running", Id: "ns=2;s=Line2.Running", Server: "plc1", Datatype: "Bool"}
+
+			// the second value of p is published within the birth window as well and must not get lost
+			stopped := p
+			stopped.Value = false
+
+			for _, v := range []Payload{p, alarm, stopped} {
+				if err := m.Publish(ctx, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			dbirth := expectMessage(t, msgs, "spBv1.0/plant/DBIRTH/geist/plc1")
+			metrics, err = decodeSparkplugMetrics(dbirth.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !metrics[p.Id] || !metrics[alarm.Id] {
+				t.Fatalf("DBIRTH does not contain the first values of all metrics: %v", metrics)
+			}
+
+			// the next messages have to be DDATA, a second DBIRTH would reset the device on the host
+			expectDDATA := func(want bool) {
+				t.Helper()
+
+				var ddata received
+				select {
+				case ddata = <-msgs:
+				case <-time.After(5 * time.Second):
+					t.Fatal("no DDATA received")
+				}
+				if ddata.topic != "spBv1.0/plant/DDATA/geist/plc1" {
+					t.Fatalf("expected DDATA, got a message on %s", ddata.topic)
+				}
+
+				metrics, err := decodeSparkplugMetrics(ddata.payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v, ok := metrics[p.Id]; !ok || v != want {
+					t.Fatalf("unexpected DDATA metrics: %v", metrics)
+				}
+			}
+
+			expectDDATA(false)
+
+			if err := m.Publish(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			expectDDATA(true)
+
+			if err := m.Shutdown(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			expectMessage(t, msgs, "spBv1.0/plant/NDEATH/geist")
+		})
+	}
+}
@@ -3,9 +3,9 @@ package handlers
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"gualogger/logging"
+	"sync"
 	"time"
 
 	"github.com/twmb/franz-go/pkg/kgo"
@@ -27,12 +27,67 @@ type Redpanda struct {
 	TLS struct {
 		InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
 	} `mapstructure:"tls"`
-	Client *kgo.Client
+	Producer struct {
+		LingerMs           int    `mapstructure:"linger_ms"`
+		BatchMaxBytes      int32  `mapstructure:"batch_max_bytes"`
+		MaxBufferedRecords int    `mapstructure:"max_buffered_records"`
+		Compression        string `mapstructure:"compression"`
+		DeliveryTimeout    int    `mapstructure:"delivery_timeout"`
+	} `mapstructure:"producer"`
+	Serializer Serializer `mapstructure:"serializer"`
+	Commands   Commands   `mapstructure:"commands"`
+	Methods    Commands   `mapstructure:"methods"`
+	Client     *kgo.Client
+
+	mu sync.RWMutex
 }
 
-// NewKafkaClient creates a new Kafka client with the given configuration
+// Initialize creates the Kafka client with the given configuration on the first call and pings the brokers.
+// Later calls only ping the existing client: kgo reconnects on its own, and replacing the client would abort the
+// records in flight while the exporter is publishing
 func (r *Redpanda) Initialize(ctx context.Context) error {
 
+	if r.client() != nil {
+		return r.Ping(ctx)
+	}
+
+	if err := r.Serializer.init(); err != nil {
+		return err
+	}
+
+	opts := r.clientOpts()
+	// records with the same key (node id) always end up in the same partition, so their order is kept
+	opts = append(opts, kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)))
+
+	popts, err := r.producerOpts()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, popts...)
+
+	client, err := kgo.NewClient(opts...)
+
+	if err != nil {
+		return err
+	}
+
+	// the client is kept even if the brokers are unreachable, it connects as soon as they are back
+	r.mu.Lock()
+	r.Client = client
+	r.mu.Unlock()
+
+	return r.Ping(ctx)
+}
+
+func (r *Redpanda) client() *kgo.Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Client
+}
+
+// clientOpts returns the connection settings shared by the producer and the command consumer
+func (r *Redpanda) clientOpts() []kgo.Opt {
+
 	opts := []kgo.Opt{
 		kgo.SeedBrokers(r.Brokers...),
 		kgo.WithLogger(logging.NewKgoLogger(logging.Logger)),
@@ -66,37 +121,61 @@ func (r *Redpanda) Initialize(ctx context.Context) error {
 		}
 	}
 
-	client, err := kgo.NewClient(opts...)
+	return opts
+}
 
-	if err != nil {
-		return err
-	}
+// producerOpts translates the producer settings into kgo options, unset values keep the kgo defaults
+func (r *Redpanda) producerOpts() ([]kgo.Opt, error) {
+	var opts []kgo.Opt
 
-	if err := client.Ping(ctx); err != nil {
-		return err
+	if r.Producer.LingerMs > 0 {
+		opts = append(opts, kgo.ProducerLinger(time.Duration(r.Producer.LingerMs)*time.Millisecond))
 	}
 
-	r.Client = client
-	return nil
-}
+	if r.Producer.BatchMaxBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(r.Producer.BatchMaxBytes))
+	}
 
-func (r *Redpanda) Publish(ctx context.Context, p Payload) error {
-	// 1. Add a timeout to the context
-	produceCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+	if r.Producer.MaxBufferedRecords > 0 {
+		opts = append(opts, kgo.MaxBufferedRecords(r.Producer.MaxBufferedRecords))
+	}
 
-	b, err := json.Marshal(p)
-	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %v", err)
+	if r.Producer.DeliveryTimeout > 0 {
+		opts = append(opts, kgo.RecordDeliveryTimeout(time.Duration(r.Producer.DeliveryTimeout)*time.Second))
 	}
 
-	topics := p.Topics
-	if len(topics) == 0 {
-		topics = []string{r.Topic}
+	switch r.Producer.Compression {
+	case "":
+	case "none":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.NoCompression()))
+	case "gzip":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.GzipCompression()))
+	case "snappy":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.SnappyCompression()))
+	case "lz4":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.Lz4Compression()))
+	case "zstd":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.ZstdCompression()))
+	default:
+		return nil, fmt.Errorf("unknown compression %q", r.Producer.Compression)
 	}
 
+	return opts, nil
+}
+
+// records builds one record per topic of the payload, keyed by the node id
+func (r *Redpanda) records(ctx context.Context, p Payload) ([]*kgo.Record, error) {
+
+	topics := p.topics(r.Topic)
+
 	recs := make([]*kgo.Record, 0, len(topics))
 	for _, topic := range topics {
+		// the schema id depends on the topic, so every record is encoded separately
+		b, err := r.Serializer.Encode(ctx, topic, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize payload: %v", err)
+		}
+
 		recs = append(recs, &kgo.Record{
 			Key:       []byte(p.Id),
 			Topic:     topic,
@@ -105,7 +184,69 @@ func (r *Redpanda) Publish(ctx context.Context, p Payload) error {
 		})
 	}
 
-	results := r.Client.ProduceSync(produceCtx, recs...)
+	return recs, nil
+}
+
+// PublishAsync hands the records of the payload to the batching producer and returns immediately
+// done is called exactly once, after all records were acknowledged or the first one failed
+// If the producer buffer is full, PublishAsync blocks until there is space again or ctx is canceled
+func (r *Redpanda) PublishAsync(ctx context.Context, p Payload, done func(error)) {
+	client := r.client()
+	if client == nil {
+		done(fmt.Errorf("redpanda client is not initialized"))
+		return
+	}
+
+	recs, err := r.records(ctx, p)
+	if err != nil {
+		done(err)
+		return
+	}
+
+	var mu sync.Mutex
+	pending := len(recs)
+	failed := false
+
+	for _, rec := range recs {
+		client.Produce(ctx, rec, func(_ *kgo.Record, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			pending--
+
+			if failed {
+				return
+			}
+
+			if err != nil {
+				failed = true
+				done(fmt.Errorf("produce failed: %v", err))
+				return
+			}
+
+			if pending == 0 {
+				done(nil)
+			}
+		})
+	}
+}
+
+func (r *Redpanda) Publish(ctx context.Context, p Payload) error {
+	client := r.client()
+	if client == nil {
+		return fmt.Errorf("redpanda client is not initialized")
+	}
+
+	// 1. Add a timeout to the context
+	produceCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	recs, err := r.records(produceCtx, p)
+	if err != nil {
+		return err
+	}
+
+	results := client.ProduceSync(produceCtx, recs...)
 
 	// 2. Correctly check for errors
 	if err := results.FirstErr(); err != nil {
@@ -115,18 +256,28 @@ func (r *Redpanda) Publish(ctx context.Context, p Payload) error {
 	return nil
 }
 
+// Shutdown waits for all buffered records to be delivered and closes the client
 func (r *Redpanda) Shutdown(ctx context.Context) error {
-	r.Client.Close()
+	if client := r.client(); client != nil {
+		if err := client.Flush(ctx); err != nil {
+			logging.Logger.Warn(fmt.Sprintf("failed to flush redpanda producer: %s", err.Error()), "func", "Shutdown")
+		}
+		client.Close()
+	}
 	return nil
 }
 
 func (r *Redpanda) Ping(ctx context.Context) error {
+	client := r.client()
+	if client == nil {
+		return fmt.Errorf("redpanda client is not initialized")
+	}
 
 	ctx_t, done := context.WithTimeout(ctx, 10*time.Second)
 
 	defer done()
 
-	if err := r.Client.Ping(ctx_t); err != nil {
+	if err := client.Ping(ctx_t); err != nil {
 		return err
 	}
 
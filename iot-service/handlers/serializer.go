@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/hamba/avro/v2"
+	"github.com/twmb/franz-go/pkg/sr"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+// avroPayloadSchema is registered for every topic if the avro format is selected
+const avroPayloadSchema = `{
+  "type": "record",
+  "name": "Payload",
+  "namespace": "com.geist_iot",
+  "fields": [
+    {"name": "value", "type": ["null", "boolean", "int", "long", "float", "double", "string", "bytes"]},
+    {"name": "ts", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "name", "type": "string"},
+    {"name": "id", "type": "string"},
+    {"name": "datatype", "type": "string"},
+    {"name": "server", "type": "string", "default": ""},
+    {"name": "meta", "type": {"type": "array", "items": {
+      "type": "record",
+      "name": "Meta",
+      "fields": [
+        {"name": "key", "type": "string"},
+        {"name": "value", "type": "string"}
+      ]
+    }}, "default": []},
+    {"name": "server_ts", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+    {"name": "quality", "type": "string", "default": ""},
+    {"name": "status_code", "type": "long", "default": 0},
+    {"name": "status", "type": "string", "default": ""}
+  ]
+}`
+
+// protoPayloadSchema is registered for every topic if the protobuf format is selected
+// Payload is the first message in the file, so the message index written after the schema id is always 0
+const protoPayloadSchema = `syntax = "proto3";
+package geist;
+
+message Payload {
+  oneof value {
+    bool bool_value = 1;
+    sint64 int_value = 2;
+    uint64 uint_value = 3;
+    float float_value = 4;
+    double double_value = 5;
+    string string_value = 6;
+    bytes bytes_value = 7;
+  }
+  int64 ts = 8;
+  string name = 9;
+  string id = 10;
+  string datatype = 11;
+  string server = 12;
+  repeated Meta meta = 13;
+  int64 server_ts = 14;
+  string quality = 15;
+  uint32 status_code = 16;
+  string status = 17;
+}
+
+message Meta {
+  string key = 1;
+  string value = 2;
+}
+`
+
+// Serializer holds the settings for the encoding of record values
+type Serializer struct {
+	Format         string `mapstructure:"format"`
+	SchemaRegistry struct {
+		URLs []string `mapstructure:"urls"`
+		Auth struct {
+			User string `mapstructure:"user"`
+			Pass string `mapstructure:"pass"`
+		} `mapstructure:"auth"`
+		TLS struct {
+			InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+		} `mapstructure:"tls"`
+	} `mapstructure:"schema_registry"`
+
+	client *sr.Client
+	avro   avro.Schema
+	mu     sync.RWMutex
+	ids    map[string]int
+}
+
+// init validates the format and creates the schema registry client if a registry based format is used
+func (s *Serializer) init() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ids = make(map[string]int)
+
+	switch s.Format {
+	case "", FormatJSON:
+		return nil
+	case FormatAvro:
+		schema, err := avro.Parse(avroPayloadSchema)
+		if err != nil {
+			return err
+		}
+		s.avro = schema
+	case FormatProtobuf:
+	default:
+		return fmt.Errorf("unknown serializer format %q", s.Format)
+	}
+
+	if len(s.SchemaRegistry.URLs) == 0 {
+		return fmt.Errorf("format %s requires at least one schema registry url", s.Format)
+	}
+
+	opts := []sr.ClientOpt{sr.URLs(s.SchemaRegistry.URLs...)}
+
+	if s.SchemaRegistry.Auth.User != "" {
+		opts = append(opts, sr.BasicAuth(s.SchemaRegistry.Auth.User, s.SchemaRegistry.Auth.Pass))
+	}
+
+	if s.SchemaRegistry.TLS.InsecureSkipVerify {
+		opts = append(opts, sr.DialTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	}
+
+	client, err := sr.NewClient(opts...)
+	if err != nil {
+		return err
+	}
+
+	s.client = client
+	return nil
+}
+
+// Encode serializes the payload for the given topic. Avro and protobuf values are prefixed with the
+// schema registry wire format header (magic byte, schema id and for protobuf the message index)
+func (s *Serializer) Encode(ctx context.Context, topic string, p Payload) ([]byte, error) {
+
+	switch s.Format {
+	case FormatAvro:
+		id, err := s.schemaID(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := avro.Marshal(s.avro, avroRecord(p))
+		if err != nil {
+			return nil, err
+		}
+
+		h, _ := new(sr.ConfluentHeader).AppendEncode(make([]byte, 0, len(b)+5), id, nil)
+		return append(h, b...), nil
+
+	case FormatProtobuf:
+		id, err := s.schemaID(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+
+		h, _ := new(sr.ConfluentHeader).AppendEncode(nil, id, []int{0})
+		return appendProtoPayload(h, p), nil
+
+	default:
+		return json.Marshal(p)
+	}
+}
+
+// schemaID registers the payload schema under the subject <topic>-value or returns the cached id
+func (s *Serializer) schemaID(ctx context.Context, topic string) (int, error) {
+
+	s.mu.RLock()
+	id, ok := s.ids[topic]
+	client := s.client
+	s.mu.RUnlock()
+
+	if ok {
+		return id, nil
+	}
+
+	schema := sr.Schema{Schema: avroPayloadSchema, Type: sr.TypeAvro}
+	if s.Format == FormatProtobuf {
+		schema = sr.Schema{Schema: protoPayloadSchema, Type: sr.TypeProtobuf}
+	}
+
+	ss, err := client.CreateSchema(ctx, topic+"-value", schema)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register schema for topic %s: %w", topic, err)
+	}
+
+	s.mu.Lock()
+	s.ids[topic] = ss.ID
+	s.mu.Unlock()
+
+	return ss.ID, nil
+}
+
+func avroRecord(p Payload) map[string]any {
+
+	meta := make([]map[string]any, 0, len(p.Meta))
+	for _, m := range p.Meta {
+		meta = append(meta, map[string]any{"key": m.Key, "value": m.Value})
+	}
+
+	var sts any
+	if !p.ServerTS.IsZero() {
+		sts = p.ServerTS
+	}
+
+	return map[string]any{
+		"value":       normalizeValue(typedValue(p)),
+		"ts":          p.TS,
+		"name":        p.Name,
+		"id":          p.Id,
+		"datatype":    p.Datatype,
+		"server":      p.Server,
+		"meta":        meta,
+		"server_ts":   sts,
+		"quality":     p.Quality,
+		"status_code": int64(p.StatusCode),
+		"status":      p.Status,
+	}
+}
+
+// typedValue restores the go type of a numeric value from the datatype of the payload
+// This is required for payloads replayed from the buffer, their numbers are decoded as json.Number
+func typedValue(p Payload) interface{} {
+
+	var f float64
+
+	switch v := p.Value.(type) {
+	case float64:
+		f = v
+	case json.Number:
+		// 64 bit integers are parsed from the literal, a float64 would round values above 2^53
+		switch p.Datatype {
+		case "i64", "Int":
+			if i, err := v.Int64(); err == nil {
+				return i
+			}
+		case "u64":
+			if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+				return u
+			}
+		}
+
+		var err error
+		if f, err = v.Float64(); err != nil {
+			return p.Value
+		}
+	default:
+		return p.Value
+	}
+
+	switch p.Datatype {
+	case "i8":
+		return int8(f)
+	case "i16":
+		return int16(f)
+	case "i32":
+		return int32(f)
+	case "i64", "Int":
+		return int64(f)
+	case "u8":
+		return uint8(f)
+	case "u16":
+		return uint16(f)
+	case "u32":
+		return uint32(f)
+	case "u64":
+		return uint64(f)
+	case "f32":
+		return float32(f)
+	}
+
+	return f
+}
+
+// normalizeValue converts a value into one of the types of the value union
+// Integers which fit into 32 bit become int, other integers long and everything else is encoded as json string
+func normalizeValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil, bool, float32, float64, string, []byte, int32, int64:
+		return t
+	case int8, int16, uint8, uint16:
+		return int32(toInt64(t))
+	case int, uint32:
+		return toInt64(t)
+	case uint64:
+		if t > math.MaxInt64 {
+			return fmt.Sprint(t)
+		}
+		return int64(t)
+	default:
+		return toString(t)
+	}
+}
+
+func appendProtoPayload(b []byte, p Payload) []byte {
+
+	switch v := typedValue(p).(type) {
+	case nil:
+	case bool:
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case int, int8, int16, int32, int64:
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(toInt64(v)))
+	case uint8, uint16, uint32, uint64:
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, toUint64(v))
+	case float32:
+		b = protowire.AppendTag(b, 4, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(v))
+	case float64:
+		b = protowire.AppendTag(b, 5, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case []byte:
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	default:
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendString(b, toString(v))
+	}
+
+	b = protowire.AppendTag(b, 8, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(p.TS.UnixMilli()))
+
+	for _, f := range []struct {
+		num protowire.Number
+		val string
+	}{{9, p.Name}, {10, p.Id}, {11, p.Datatype}, {12, p.Server}} {
+		if f.val == "" {
+			continue
+		}
+		b = protowire.AppendTag(b, f.num, protowire.BytesType)
+		b = protowire.AppendString(b, f.val)
+	}
+
+	for _, m := range p.Meta {
+		var mb []byte
+		mb = protowire.AppendTag(mb, 1, protowire.BytesType)
+		mb = protowire.AppendString(mb, m.Key)
+		mb = protowire.AppendTag(mb, 2, protowire.BytesType)
+		mb = protowire.AppendString(mb, m.Value)
+
+		b = protowire.AppendTag(b, 13, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+
+	if !p.ServerTS.IsZero() {
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(p.ServerTS.UnixMilli()))
+	}
+
+	for _, f := range []struct {
+		num protowire.Number
+		val string
+	}{{15, p.Quality}, {17, p.Status}} {
+		if f.val == "" {
+			continue
+		}
+		b = protowire.AppendTag(b, f.num, protowire.BytesType)
+		b = protowire.AppendString(b, f.val)
+	}
+
+	if p.StatusCode != 0 {
+		b = protowire.AppendTag(b, 16, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(p.StatusCode))
+	}
+
+	return b
+}
@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const sparkplugNamespace = "spBv1.0"
+
+// Sparkplug B metric datatypes as defined in the Sparkplug specification
+const (
+	spInt8     uint32 = 1
+	spInt16    uint32 = 2
+	spInt32    uint32 = 3
+	spInt64    uint32 = 4
+	spUInt8    uint32 = 5
+	spUInt16   uint32 = 6
+	spUInt32   uint32 = 7
+	spUInt64   uint32 = 8
+	spFloat    uint32 = 9
+	spDouble   uint32 = 10
+	spBoolean  uint32 = 11
+	spString   uint32 = 12
+	spDateTime uint32 = 13
+)
+
+const spRebirthMetric = "Node Control/Rebirth"
+
+// Sparkplug holds the settings for Sparkplug B encoded MQTT messages
+type Sparkplug struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	GroupID    string `mapstructure:"group_id"`
+	EdgeNodeID string `mapstructure:"edge_node_id"`
+	DeviceID   string `mapstructure:"device_id"`
+	// BirthWindowMs is the time values of new metrics are collected before they are announced in a single DBIRTH
+	BirthWindowMs int `mapstructure:"birth_window_ms"`
+}
+
+func (s *Sparkplug) birthWindow() time.Duration {
+	if s.BirthWindowMs > 0 {
+		return time.Duration(s.BirthWindowMs) * time.Millisecond
+	}
+	return 2 * time.Second
+}
+
+// spDevice holds the latest value of every metric of a device, born marks the metrics announced in the last DBIRTH
+// and pending is set while new metrics are collected for the next DBIRTH. queued keeps the values of metrics which
+// are not born yet in the order they were published, they are sent after the DBIRTH
+type spDevice struct {
+	metrics map[string]spMetric
+	born    map[string]bool
+	pending bool
+	queued  []spMetric
+}
+
+// spMaxQueued limits the values waiting for the DBIRTH of a device, further values are rejected so the export
+// worker buffers them
+const spMaxQueued = 10000
+
+type spMetric struct {
+	name string
+	// displayName is sent as property of the metric in the DBIRTH
+	displayName string
+	ts          time.Time
+	datatype    uint32
+	value       interface{}
+}
+
+// spTopic builds a topic in format spBv1.0/{group_id}/{message_type}/{edge_node_id}[/{device_id}]
+func (s *Sparkplug) spTopic(msgType string, device string) string {
+	t := fmt.Sprintf("%s/%s/%s/%s", sparkplugNamespace, s.GroupID, msgType, s.EdgeNodeID)
+	if device != "" {
+		t += "/" + device
+	}
+	return t
+}
+
+// deviceFor returns the sparkplug device a payload belongs to, the opc ua server name is used if no device id is configured
+func (s *Sparkplug) deviceFor(p Payload) string {
+	if s.DeviceID != "" {
+		return s.DeviceID
+	}
+	if p.Server != "" {
+		return p.Server
+	}
+	return "opcua"
+}
+
+// metricFromPayload maps the connector datatype of a payload to the matching sparkplug datatype
+// The metric is named after the node id, display names are not unique within a server
+func metricFromPayload(p Payload) spMetric {
+	m := spMetric{name: p.Id, displayName: p.Name, ts: p.TS, value: p.Value}
+
+	if m.name == "" {
+		m.name = p.Name
+	}
+
+	switch p.Datatype {
+	case "i8":
+		m.datatype = spInt8
+	case "i16":
+		m.datatype = spInt16
+	case "i32":
+		m.datatype = spInt32
+	case "i64", "Int":
+		m.datatype = spInt64
+	case "u8":
+		m.datatype = spUInt8
+	case "u16":
+		m.datatype = spUInt16
+	case "u32":
+		m.datatype = spUInt32
+	case "u64":
+		m.datatype = spUInt64
+	case "f32":
+		m.datatype = spFloat
+	case "f64":
+		m.datatype = spDouble
+	case "Bool":
+		m.datatype = spBoolean
+	case "DateTime":
+		m.datatype = spDateTime
+	default:
+		m.datatype = spString
+	}
+
+	return m
+}
+
+// encodeSparkplugPayload encodes a Sparkplug B payload protobuf message
+// seq is omitted if it is negative, which is required for NDEATH messages
+func encodeSparkplugPayload(ts time.Time, seq int, metrics []spMetric) []byte {
+	var b []byte
+
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(ts.UnixMilli()))
+
+	for _, m := range metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeSparkplugMetric(m))
+	}
+
+	if seq >= 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(seq))
+	}
+
+	return b
+}
+
+func encodeSparkplugMetric(m spMetric) []byte {
+	var b []byte
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, m.name)
+
+	if !m.ts.IsZero() {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.ts.UnixMilli()))
+	}
+
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.datatype))
+
+	if m.displayName != "" && m.displayName != m.name {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeSparkplugProperty("displayName", m.displayName))
+	}
+
+	if m.value == nil {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		return protowire.AppendVarint(b, 1)
+	}
+
+	switch m.datatype {
+	case spInt8, spInt16, spInt32:
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(uint32(int32(toInt64(m.value)))))
+	case spUInt8, spUInt16, spUInt32:
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(uint32(toUint64(m.value))))
+	case spInt64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(toInt64(m.value)))
+	case spUInt64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, toUint64(m.value))
+	case spDateTime:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(toTime(m.value).UnixMilli()))
+	case spFloat:
+		b = protowire.AppendTag(b, 12, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(float32(toFloat64(m.value))))
+	case spDouble:
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(toFloat64(m.value)))
+	case spBoolean:
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(toBool(m.value)))
+	default:
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, toString(m.value))
+	}
+
+	return b
+}
+
+// encodeSparkplugProperty encodes a PropertySet with a single string property
+func encodeSparkplugProperty(key string, value string) []byte {
+	var v []byte
+
+	v = protowire.AppendTag(v, 1, protowire.VarintType)
+	v = protowire.AppendVarint(v, uint64(spString))
+	v = protowire.AppendTag(v, 8, protowire.BytesType)
+	v = protowire.AppendString(v, value)
+
+	var b []byte
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, v)
+
+	return b
+}
+
+// decodeSparkplugMetrics returns the names and boolean values of all metrics in a Sparkplug B payload
+// It is only used for node control commands, other value types are ignored
+func decodeSparkplugMetrics(b []byte) (map[string]bool, error) {
+	res := make(map[string]bool)
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num != 2 || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		mb, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var name string
+		var value bool
+
+		for len(mb) > 0 {
+			mnum, mtyp, mn := protowire.ConsumeTag(mb)
+			if mn < 0 {
+				return nil, protowire.ParseError(mn)
+			}
+			mb = mb[mn:]
+
+			switch {
+			case mnum == 1 && mtyp == protowire.BytesType:
+				s, l := protowire.ConsumeString(mb)
+				if l < 0 {
+					return nil, protowire.ParseError(l)
+				}
+				name = s
+				mn = l
+			case mnum == 14 && mtyp == protowire.VarintType:
+				v, l := protowire.ConsumeVarint(mb)
+				if l < 0 {
+					return nil, protowire.ParseError(l)
+				}
+				value = protowire.DecodeBool(v)
+				mn = l
+			default:
+				mn = protowire.ConsumeFieldValue(mnum, mtyp, mb)
+				if mn < 0 {
+					return nil, protowire.ParseError(mn)
+				}
+			}
+			mb = mb[mn:]
+		}
+
+		res[name] = value
+	}
+
+	return res, nil
+}
+
+func toInt64(v interface{}) int64 {
+	switch t := v.(type) {
+	case int:
+		return int64(t)
+	case int8:
+		return int64(t)
+	case int16:
+		return int64(t)
+	case int32:
+		return int64(t)
+	case int64:
+		return t
+	case uint8:
+		return int64(t)
+	case uint16:
+		return int64(t)
+	case uint32:
+		return int64(t)
+	case uint64:
+		return int64(t)
+	case float32:
+		return int64(t)
+	case float64:
+		return int64(t)
+	case bool:
+		if t {
+			return 1
+		}
+		return 0
+	case json.Number:
+		i, _ := t.Int64()
+		return i
+	case string:
+		i, _ := strconv.ParseInt(t, 10, 64)
+		return i
+	}
+	return 0
+}
+
+func toUint64(v interface{}) uint64 {
+	switch t := v.(type) {
+	case uint64:
+		return t
+	case json.Number:
+		if u, err := strconv.ParseUint(t.String(), 10, 64); err == nil {
+			return u
+		}
+	case float64:
+		return uint64(t)
+	case float32:
+		return uint64(t)
+	case string:
+		u, _ := strconv.ParseUint(t, 10, 64)
+		return u
+	}
+	return uint64(toInt64(v))
+}
+
+func toFloat64(v interface{}) float64 {
+	switch t := v.(type) {
+	case float32:
+		return float64(t)
+	case float64:
+		return t
+	case json.Number:
+		f, _ := t.Float64()
+		return f
+	case string:
+		f, _ := strconv.ParseFloat(t, 64)
+		return f
+	}
+	return float64(toInt64(v))
+}
+
+func toBool(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		b, _ := strconv.ParseBool(t)
+		return b
+	}
+	return toInt64(v) != 0
+}
+
+func toTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case time.Time:
+		return t
+	case string:
+		ts, _ := time.Parse(time.RFC3339Nano, t)
+		return ts
+	}
+	return time.UnixMilli(toInt64(v))
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case fmt.Stringer:
+		return t.String()
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -5,15 +5,43 @@ import (
 	"time"
 )
 
+// DatatypeEvent marks payloads of opcua events, their value holds the selected event fields by name
+const DatatypeEvent = "Event"
+
+// Quality of a value, derived from the severity of its opcua status code
+const (
+	QualityGood      = "Good"
+	QualityUncertain = "Uncertain"
+	QualityBad       = "Bad"
+)
+
+// Payload is a single value or event published to the exporters
+// TS is the source timestamp of the value and falls back to the server timestamp if the source did not provide one
 type Payload struct {
-	Value    interface{} `json:"value"`
-	TS       time.Time   `json:"ts"`
-	Name     string      `json:"name"`
-	Id       string      `json:"id"`
-	Datatype string      `json:"datatype"`
-	Server   string      `json:"server"`
-	Meta     []Meta      `json:"meta"`
-	Topics   []string    `json:"-"`
+	Value      interface{} `json:"value"`
+	TS         time.Time   `json:"ts"`
+	ServerTS   time.Time   `json:"server_ts,omitzero"`
+	Name       string      `json:"name"`
+	Id         string      `json:"id"`
+	Datatype   string      `json:"datatype"`
+	Quality    string      `json:"quality,omitempty"`
+	StatusCode uint32      `json:"status_code"`
+	Status     string      `json:"status,omitempty"`
+	Server     string      `json:"server"`
+	Meta       []Meta      `json:"meta"`
+	Topics     []string    `json:"-"`
+}
+
+// topics returns the topics of the payload, payloads without topics are sent to the default topic of the exporter
+// and events to <default>-events, so they are not mixed with the values of nodes
+func (p Payload) topics(def string) []string {
+	switch {
+	case len(p.Topics) > 0:
+		return p.Topics
+	case p.Datatype == DatatypeEvent:
+		return []string{def + "-events"}
+	}
+	return []string{def}
 }
 
 type Meta struct {
@@ -21,8 +49,17 @@ type Meta struct {
 	Value string `json:"value"`
 }
 
+// Exporter is implemented by every sink the connector can publish payloads to
 type Exporter interface {
 	Initialize(ctx context.Context) error
 	Publish(ctx context.Context, p Payload) error
+	Ping(ctx context.Context) error
 	Shutdown(ctx context.Context) error
 }
+
+// AsyncExporter is implemented by exporters which batch payloads internally
+// done has to be called exactly once with the delivery result of the payload
+type AsyncExporter interface {
+	Exporter
+	PublishAsync(ctx context.Context, p Payload, done func(error))
+}
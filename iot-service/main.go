@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"gualogger/logging"
 	"os"
+	"os/signal"
+	"syscall"
+	"testing"
 )
 
 var (
@@ -18,6 +21,11 @@ func init() {
 
 	logging.InitLogger(l)
 
+	// tests construct what they need themselves and run without a configuration file
+	if testing.Testing() {
+		return
+	}
+
 	var err error
 
 	conf, err = LoadConfig()
@@ -30,16 +38,108 @@ func init() {
 }
 
 func main() {
-	ctx := context.Background()
 
-	mgr = NewManager(&conf.Redpanda)
+	// acquisition stops on SIGTERM, the exporters keep running until the queued payloads are delivered
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	ectx, ecancel := context.WithCancel(context.Background())
+	defer ecancel()
+
+	var err error
+
+	mgr, err = NewManager(conf.Exporters, conf.Buffer, conf.Export)
+
+	if err != nil {
+		logging.Logger.Error(err.Error(), "func", "main")
+		return
+	}
+
+	// the endpoints are served while the exporters are initialized, so the connector is alive but not ready yet
+	sm := NewServerManager(ctx)
+	go ServeStatus(ctx, conf.HTTP, conf.Metrics, sm, mgr)
 
 	if err := mgr.SetupPubHandler(ctx); err != nil {
 		logging.Logger.Error(err.Error(), "func", "main")
+		mgr.Shutdown(context.Background())
+		return
+	}
+
+	mgr.Run(ectx)
+
+	servers, err := conf.Opcua.Servers()
+
+	if err != nil {
+		logging.Logger.Error(err.Error(), "func", "main")
+		ecancel()
+		mgr.Shutdown(context.Background())
 		return
 	}
 
-	go mgr.VerifyConnection(ctx)
+	sm.Apply(servers)
+
+	if _, ok := conf.Exporters["redpanda"]; ok {
+		if conf.Redpanda.Commands.Enabled() {
+			go func() {
+				if err := conf.Redpanda.ConsumeCommands(ctx, conf.Metrics.connector(), sm.Write); err != nil {
+					logging.Logger.Error(err.Error(), "func", "main")
+				}
+			}()
+		}
+
+		if conf.Redpanda.Methods.Enabled() {
+			go func() {
+				if err := conf.Redpanda.ConsumeMethods(ctx, conf.Metrics.connector(), sm.Call); err != nil {
+					logging.Logger.Error(err.Error(), "func", "main")
+				}
+			}()
+		}
+	}
+
+	conf.Watch(func(c *Configuration) {
+		servers, err := c.Opcua.Servers()
+
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("changed configuration is not applied: %s", err.Error()), "func", "main")
+			return
+		}
+
+		sm.Apply(servers)
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		sm.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-ctx.Done():
+		logging.Logger.Info(fmt.Sprintf("received shutdown signal - stopping within %s", conf.Shutdown.gracePeriod()))
+	case <-stopped:
+		logging.Logger.Warn("all opcua connections stopped - shutting down", "func", "main")
+	}
+	stop()
+
+	shutdown(sm, stopped, ecancel)
+}
+
+// shutdown stops the acquisition, unsubscribes and closes all sessions, then flushes and stops the exporters
+// All steps share the configured grace period
+func shutdown(sm *ServerManager, stopped <-chan struct{}, stopExport context.CancelFunc) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Shutdown.gracePeriod())
+	defer cancel()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logging.Logger.Warn("opcua sessions not closed before the end of the grace period", "func", "shutdown")
+	}
+
+	mgr.Flush(ctx)
+	stopExport()
+	mgr.Shutdown(ctx)
 
-	conf.Opcua.InitSuperVisor(ctx)
+	logging.Logger.Info("shutdown complete")
 }
@@ -1,53 +1,615 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"gualogger/buffer"
 	"gualogger/handlers"
 	"gualogger/logging"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	OverflowBlock      = "block"
+	OverflowDropNewest = "drop_newest"
+	OverflowDropOldest = "drop_oldest"
+)
+
 type ExportManager struct {
-	redpandaInstance *handlers.Redpanda
+	workers []*exportWorker
+	conf    ExportConfig
+}
+
+// ExportConfig holds the settings shared by all exporters
+type ExportConfig struct {
+	QueueSize     int    `mapstructure:"queue_size"`
+	MaxInFlight   int    `mapstructure:"max_in_flight"`
+	Overflow      string `mapstructure:"overflow"`
+	InitRetries   int    `mapstructure:"init_retries"`
+	RetryInterval int    `mapstructure:"retry_interval"`
+	PingInterval  int    `mapstructure:"ping_interval"`
+}
+
+// exportWorker decouples a single exporter from the others, each worker owns its queue, buffer and health state
+type exportWorker struct {
+	name     string
+	exporter handlers.Exporter
+	buffer   *buffer.Queue
+	queue    chan handlers.Payload
+	overflow string
+	inFlight chan struct{}
+
+	// pending counts the payloads from entering the queue until they were delivered, failed or buffered, so Flush
+	// also sees the payload which was just taken from the queue
+	pending atomic.Int64
+
+	// async tracks the asynchronous publishes, payloads failing among them are collected in failedAsync and
+	// buffered in the order they were published, failedCh wakes up the worker to buffer them
+	async       sync.WaitGroup
+	seq         uint64
+	failedMu    sync.Mutex
+	failedAsync []failedPayload
+	failedCh    chan struct{}
+
+	received  atomic.Uint64
+	published atomic.Uint64
+	failed    atomic.Uint64
+	dropped   atomic.Uint64
+	spilled   atomic.Uint64
+
+	mu        sync.RWMutex
+	healthy   bool
+	lastErr   error
+	lastErrTS time.Time
+}
+
+// ExporterHealth is a snapshot of the state of a single exporter
+type ExporterHealth struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Queued    int       `json:"queued"`
+	InFlight  int       `json:"in_flight"`
+	Buffered  int       `json:"buffered"`
+	Received  uint64    `json:"received"`
+	Published uint64    `json:"published"`
+	Failed    uint64    `json:"failed"`
+	Dropped   uint64    `json:"dropped"`
+	LastError string    `json:"last_error,omitempty"`
+	LastErrTS time.Time `json:"last_error_ts,omitzero"`
 }
 
-// Initializes a new manager instance
-func NewManager(r *handlers.Redpanda) *ExportManager {
+// failedPayload is an asynchronously published payload which failed, seq is its position in the publishing order
+type failedPayload struct {
+	seq uint64
+	p   handlers.Payload
+}
+
+// bufferedPayload is the on-disk representation of a payload, Topics are not part of the json payload itself
+type bufferedPayload struct {
+	Payload handlers.Payload `json:"payload"`
+	Topics  []string         `json:"topics"`
+}
+
+// Initializes a new manager instance with one worker per enabled exporter
+// If buffering is enabled, every exporter gets its own buffer in a subdirectory named after its config key
+func NewManager(exporters map[string]handlers.Exporter, bc buffer.Config, ec ExportConfig) (*ExportManager, error) {
+
+	if ec.QueueSize <= 0 {
+		ec.QueueSize = 1000
+	}
+
+	if ec.RetryInterval <= 0 {
+		ec.RetryInterval = 10
+	}
+
+	if ec.PingInterval <= 0 {
+		ec.PingInterval = 60
+	}
+
+	if ec.MaxInFlight <= 0 {
+		ec.MaxInFlight = 1000
+	}
+
+	switch ec.Overflow {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	case "":
+		ec.Overflow = OverflowDropNewest
+	default:
+		return nil, fmt.Errorf("unknown export overflow policy %q", ec.Overflow)
+	}
+
 	m := new(ExportManager)
-	m.redpandaInstance = r
-	return m
+	m.conf = ec
+
+	names := make([]string, 0, len(exporters))
+	for n := range exporters {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+
+		w := &exportWorker{
+			name:     n,
+			exporter: exporters[n],
+			queue:    make(chan handlers.Payload, ec.QueueSize),
+			overflow: ec.Overflow,
+			inFlight: make(chan struct{}, ec.MaxInFlight),
+			failedCh: make(chan struct{}, 1),
+		}
+
+		if bc.Enabled {
+			c := bc
+			if c.Directory == "" {
+				c.Directory = "./data/buffer"
+			}
+			c.Directory = filepath.Join(c.Directory, n)
+
+			q, err := buffer.Open(c)
+
+			if err != nil {
+				return nil, fmt.Errorf("error while opening buffer for exporter %s: %w", n, err)
+			}
+
+			w.buffer = q
+			logging.Logger.Info(fmt.Sprintf("store-and-forward buffer enabled for exporter %s - %d payloads pending", n, q.Len()), "func", "NewManager")
+		}
+
+		m.workers = append(m.workers, w)
+	}
+
+	if len(m.workers) == 0 {
+		return nil, fmt.Errorf("no exporter configured")
+	}
+
+	return m, nil
 }
 
 // Setup exporter by calling the Initialize() function of each exporters interface
-// If the initialization of one exporter fails, the first error gets returned
+// Every exporter is retried up to init_retries times. An error is only returned if no exporter could be
+// initialized and there is no buffer to hold the payloads until the background reconnect succeeds
 func (m *ExportManager) SetupPubHandler(ctx context.Context) error {
 
-	if err := m.redpandaInstance.Initialize(ctx); err != nil {
-		return err
+	var wg sync.WaitGroup
+
+	for _, w := range m.workers {
+		wg.Add(1)
+		go func(w *exportWorker) {
+			defer wg.Done()
+
+			for i := 0; i <= m.conf.InitRetries; i++ {
+				if i > 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Duration(m.conf.RetryInterval) * time.Second):
+					}
+				}
+
+				if err := w.initialize(ctx); err != nil {
+					logging.Logger.Warn(fmt.Sprintf("failed to initialize exporter %s (attempt %d/%d): %s", w.name, i+1, m.conf.InitRetries+1, err.Error()), "func", "SetupPubHandler")
+					continue
+				}
+				return
+			}
+		}(w)
 	}
 
-	logging.Logger.Info("successfully connected to redpanda brokers")
-	return nil
+	wg.Wait()
+
+	var firstErr error
+
+	for _, w := range m.workers {
+		h := w.health()
+		if h.Healthy || w.buffer != nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("exporter %s: %s", w.name, h.LastError)
+		}
+	}
+
+	return firstErr
 }
 
+// Run starts one publishing and one supervising goroutine per exporter
+func (m *ExportManager) Run(ctx context.Context) {
+	for _, w := range m.workers {
+		go w.run(ctx)
+		go w.supervise(ctx, time.Duration(m.conf.PingInterval)*time.Second)
+	}
+}
+
+// Publish fans the payload out to all exporters. If the queue of an exporter is full, the payload gets
+// buffered on disk for this exporter, or the overflow policy is applied if there is no buffer.
+// Only the block policy lets a slow exporter hold up the caller
 func (m *ExportManager) Publish(ctx context.Context, p handlers.Payload) {
-	m.redpandaInstance.Publish(ctx, p)
+	for _, w := range m.workers {
+		w.enqueue(ctx, p)
+	}
 }
 
-func (m *ExportManager) VerifyConnection(ctx context.Context) {
+// Health returns the state of all exporters
+func (m *ExportManager) Health() []ExporterHealth {
+	hs := make([]ExporterHealth, 0, len(m.workers))
+	for _, w := range m.workers {
+		hs = append(hs, w.health())
+	}
+	return hs
+}
+
+// Flush blocks until the queues of all exporters are empty and all payloads in flight are acknowledged or ctx is done
+// The workers have to be running, so no new payloads may be published while flushing
+func (m *ExportManager) Flush(ctx context.Context) {
+
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+
 	for {
+		var pending int64
+		for _, w := range m.workers {
+			pending += w.pending.Load()
+		}
+
+		if pending == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			logging.Logger.Warn(fmt.Sprintf("%d payloads not delivered before the end of the grace period", pending), "func", "Flush")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Shutdown stops all exporters and closes their buffers, payloads still queued are moved to the buffer
+// The workers have to be stopped before
+func (m *ExportManager) Shutdown(ctx context.Context) {
+	for _, w := range m.workers {
+		if err := w.exporter.Shutdown(ctx); err != nil {
+			logging.Logger.Error(fmt.Sprintf("error while shutting down exporter %s: %s", w.name, err.Error()), "func", "Shutdown")
+		}
+
+		// the exporter has acknowledged or failed all payloads in flight, failed ones are older than the queued ones
+		w.settle()
+		w.spill()
+
+		if w.buffer != nil {
+			w.buffer.Close()
+		}
+	}
+}
+
+func (w *exportWorker) initialize(ctx context.Context) error {
+	err := w.exporter.Initialize(ctx)
+	w.setHealth(err)
+
+	if err == nil {
+		logging.Logger.Info(fmt.Sprintf("successfully initialized exporter %s", w.name))
+	}
+	return err
+}
+
+func (w *exportWorker) enqueue(ctx context.Context, p handlers.Payload) {
+
+	w.received.Add(1)
+
+	if w.push(p) {
+		return
+	}
+
+	if w.buffer != nil {
+		w.spilled.Add(1)
+		w.store(p)
+		return
+	}
+
+	switch w.overflow {
+	case OverflowBlock:
+		w.pending.Add(1)
+		select {
+		case w.queue <- p:
+		case <-ctx.Done():
+			w.pending.Add(-1)
+			w.dropped.Add(1)
+		}
+	case OverflowDropOldest:
+		select {
+		case <-w.queue:
+			w.pending.Add(-1)
+			w.dropped.Add(1)
+		default:
+		}
+		if !w.push(p) {
+			w.dropped.Add(1)
+		}
+	default:
+		w.dropped.Add(1)
+	}
+}
 
-		err := m.redpandaInstance.Ping(ctx)
+// push adds the payload to the queue if there is space, it is counted as pending before it can be taken from the queue
+func (w *exportWorker) push(p handlers.Payload) bool {
+
+	w.pending.Add(1)
+
+	select {
+	case w.queue <- p:
+		return true
+	default:
+		w.pending.Add(-1)
+		return false
+	}
+}
+
+func (w *exportWorker) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-w.queue:
+			w.publish(ctx, p)
+		case <-w.failedCh:
+			w.settle()
+		}
+	}
+}
+
+// publish sends the payload to the exporter. As long as older payloads are buffered, new ones are
+// appended to the buffer as well to keep the original order
+func (w *exportWorker) publish(ctx context.Context, p handlers.Payload) {
+
+	if w.buffer != nil && (w.buffer.Len() > 0 || !w.health().Healthy || w.hasFailed()) {
+		// payloads in flight are older, so their failures are buffered first
+		w.settle()
+		w.store(p)
+		w.pending.Add(-1)
+		return
+	}
+
+	if ae, ok := w.exporter.(handlers.AsyncExporter); ok {
+		// blocks if max_in_flight payloads are not acknowledged yet, which lets the queue fill up
+		select {
+		case w.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			w.pending.Add(-1)
+			return
+		}
+
+		w.seq++
+		seq := w.seq
+		w.async.Add(1)
+
+		start := time.Now()
+		ae.PublishAsync(ctx, p, func(err error) {
+			w.observe(p, start, err)
+
+			// failed payloads stay pending until settle buffered them
+			if w.delivered(p, err) {
+				w.failedMu.Lock()
+				w.failedAsync = append(w.failedAsync, failedPayload{seq: seq, p: p})
+				w.failedMu.Unlock()
+
+				select {
+				case w.failedCh <- struct{}{}:
+				default:
+				}
+			} else {
+				w.pending.Add(-1)
+			}
+
+			<-w.inFlight
+			w.async.Done()
+		})
+		return
+	}
+
+	start := time.Now()
+	err := w.exporter.Publish(ctx, p)
+	w.observe(p, start, err)
+
+	if w.delivered(p, err) {
+		w.store(p)
+	}
+	w.pending.Add(-1)
+}
+
+// delivered records the delivery result of a payload and reports whether the failed payload has to be buffered
+func (w *exportWorker) delivered(p handlers.Payload, err error) bool {
+	w.setHealth(err)
+
+	if err == nil {
+		w.published.Add(1)
+		return false
+	}
+
+	w.failed.Add(1)
+	logging.Logger.Warn(fmt.Sprintf("exporter %s failed to publish payload for node %s: %s", w.name, p.Id, err.Error()), "func", "delivered")
+
+	return w.buffer != nil
+}
+
+func (w *exportWorker) hasFailed() bool {
+	w.failedMu.Lock()
+	defer w.failedMu.Unlock()
+	return len(w.failedAsync) > 0
+}
+
+// settle waits until all asynchronous publishes are finished and buffers the failed payloads in the order they were
+// published. Acknowledgements of different partitions arrive in any order, so the failures are sorted first
+// It is only called by the publishing goroutine or after it stopped
+func (w *exportWorker) settle() {
+
+	w.async.Wait()
+
+	w.failedMu.Lock()
+	failed := w.failedAsync
+	w.failedAsync = nil
+	w.failedMu.Unlock()
+
+	sort.Slice(failed, func(i, j int) bool { return failed[i].seq < failed[j].seq })
+
+	for _, f := range failed {
+		w.store(f.p)
+		w.pending.Add(-1)
+	}
+}
+
+// spill moves all queued payloads to the buffer, they are dropped if the exporter has no buffer
+func (w *exportWorker) spill() {
+	for {
+		select {
+		case p := <-w.queue:
+			w.pending.Add(-1)
+			if w.buffer == nil {
+				w.dropped.Add(1)
+				continue
+			}
+			w.spilled.Add(1)
+			w.store(p)
+		default:
+			return
+		}
+	}
+}
+
+func (w *exportWorker) store(p handlers.Payload) {
+
+	b, err := json.Marshal(bufferedPayload{Payload: p, Topics: p.Topics})
+
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("failed to encode payload for buffer: %s", err.Error()), "func", "store")
+		return
+	}
+
+	if err := w.buffer.Append(b); err != nil {
+		logging.Logger.Error(fmt.Sprintf("failed to buffer payload for node %s on exporter %s: %s", p.Id, w.name, err.Error()), "func", "store")
+	}
+}
+
+// drain replays all buffered payloads in order, it stops at the first payload which can not be published
+func (w *exportWorker) drain(ctx context.Context) {
+
+	if w.buffer == nil || w.buffer.Len() == 0 {
+		return
+	}
+
+	logging.Logger.Info(fmt.Sprintf("replaying %d buffered payloads on exporter %s", w.buffer.Len(), w.name), "func", "drain")
+
+	n, err := w.buffer.Drain(func(rec []byte) error {
+		var bp bufferedPayload
+
+		// numbers are kept as json.Number, so 64 bit integers are replayed exactly
+		dec := json.NewDecoder(bytes.NewReader(rec))
+		dec.UseNumber()
+
+		if err := dec.Decode(&bp); err != nil {
+			logging.Logger.Error(fmt.Sprintf("discarding corrupt buffer record: %s", err.Error()), "func", "drain")
+			return nil
+		}
+
+		bp.Payload.Topics = bp.Topics
+		return w.exporter.Publish(ctx, bp.Payload)
+	})
+
+	if err != nil {
+		w.setHealth(err)
+		logging.Logger.Warn(fmt.Sprintf("replay of buffered payloads on exporter %s interrupted after %d payloads: %s", w.name, n, err.Error()), "func", "drain")
+		return
+	}
+
+	logging.Logger.Info(fmt.Sprintf("successfully replayed %d buffered payloads on exporter %s - dropped in total: %d", n, w.name, w.buffer.Dropped()), "func", "drain")
+}
+
+// supervise periodically pings the exporter, reinitializes it if it is unreachable and replays its buffer once it is back
+func (w *exportWorker) supervise(ctx context.Context, interval time.Duration) {
+
+	var lastDropped, lastSpilled uint64
+
+	for {
+
+		if d := w.dropped.Load(); d > lastDropped {
+			logging.Logger.Warn(fmt.Sprintf("exporter %s dropped %d payloads since the last check - overflow policy: %s", w.name, d-lastDropped, w.overflow), "func", "supervise")
+			lastDropped = d
+		}
+
+		if s := w.spilled.Load(); s > lastSpilled {
+			logging.Logger.Warn(fmt.Sprintf("exporter %s moved %d payloads to the disk buffer due to a full queue", w.name, s-lastSpilled), "func", "supervise")
+			lastSpilled = s
+		}
+
+		err := w.exporter.Ping(ctx)
 
 		if err != nil {
-			logging.Logger.Warn("unable to ping")
+			logging.Logger.Warn(fmt.Sprintf("unable to ping exporter %s: %s", w.name, err.Error()), "func", "supervise")
 
-			m.SetupPubHandler(ctx)
+			if err := w.initialize(ctx); err != nil {
+				logging.Logger.Warn(fmt.Sprintf("unable to reinitialize exporter %s: %s", w.name, err.Error()), "func", "supervise")
+			}
+
+		} else {
+			w.setHealth(nil)
+			w.drain(ctx)
+		}
+
+		wait := interval
+
+		// check more frequently while payloads are waiting to be replayed
+		if w.buffer != nil && w.buffer.Len() > 0 {
+			wait = min(interval, 10*time.Second)
+		}
 
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
 		}
+	}
+}
+
+func (w *exportWorker) setHealth(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-		time.Sleep(60 * time.Second)
+	w.healthy = err == nil
+
+	if err != nil {
+		w.lastErr = err
+		w.lastErrTS = time.Now()
+	}
+}
+
+func (w *exportWorker) health() ExporterHealth {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	h := ExporterHealth{
+		Name:      w.name,
+		Healthy:   w.healthy,
+		Queued:    len(w.queue),
+		InFlight:  len(w.inFlight),
+		Received:  w.received.Load(),
+		Published: w.published.Load(),
+		Failed:    w.failed.Load(),
+		Dropped:   w.dropped.Load(),
+		LastErrTS: w.lastErrTS,
+	}
+
+	if w.lastErr != nil {
+		h.LastError = w.lastErr.Error()
+	}
 
+	if w.buffer != nil {
+		h.Buffered = w.buffer.Len()
 	}
 
+	return h
 }
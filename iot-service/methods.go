@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"reflect"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Call calls a method on the addressed server, the request is rejected if the method is not callable
+// Requests for servers which are not configured are left to the connector of the server
+func (m *ServerManager) Call(ctx context.Context, req handlers.CallRequest) (handlers.CallReply, bool) {
+
+	s := m.server(req.Server)
+	if s == nil && req.Server != "" {
+		return handlers.CallReply{}, false
+	}
+	if s == nil {
+		return callReply(req, nil, ua.StatusBadInvalidArgument, errors.New("server is required if more than one server is configured")), true
+	}
+
+	req.Server = s.Name
+
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	return s.call(ctx, req), true
+}
+
+func callReply(req handlers.CallRequest, res *ua.CallMethodResult, code ua.StatusCode, err error) handlers.CallReply {
+
+	r := handlers.CallReply{
+		CorrelationID: req.CorrelationID,
+		Server:        req.Server,
+		ObjectID:      req.ObjectID,
+		MethodID:      req.MethodID,
+		StatusCode:    uint32(code),
+		TS:            time.Now(),
+	}
+
+	_, r.Status = quality(code)
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	// the input results are only of interest if the server rejected an argument
+	if res != nil && code != ua.StatusOK {
+		for _, c := range res.InputArgumentResults {
+			_, status := quality(c)
+			r.InputResults = append(r.InputResults, status)
+		}
+	}
+
+	return r
+}
+
+// call validates the arguments of the request against the InputArguments of the method and calls it through the
+// client of the current session
+func (s *OpcServer) call(ctx context.Context, req handlers.CallRequest) handlers.CallReply {
+
+	obj, err := s.parseNodeID(req.ObjectID)
+	if err != nil {
+		return callReply(req, nil, ua.StatusBadNodeIDInvalid, fmt.Errorf("invalid object id: %w", err))
+	}
+
+	method, err := s.parseNodeID(req.MethodID)
+	if err != nil {
+		return callReply(req, nil, ua.StatusBadNodeIDInvalid, fmt.Errorf("invalid method id: %w", err))
+	}
+
+	if !s.callable(obj, method) {
+		return callReply(req, nil, ua.StatusBadUserAccessDenied, errors.New("method is not callable"))
+	}
+
+	o := s.session()
+	if o == nil {
+		return callReply(req, nil, ua.StatusBadServerNotConnected, errors.New("server is not connected"))
+	}
+
+	inputs, err := methodArguments(ctx, o.c, method, "InputArguments")
+	if err != nil {
+		return callReply(req, nil, ua.StatusBadCommunicationError, fmt.Errorf("error reading input arguments: %w", err))
+	}
+
+	args, err := callArguments(inputs, req.Arguments)
+	if err != nil {
+		return callReply(req, nil, ua.StatusBadInvalidArgument, err)
+	}
+
+	res, err := o.c.Call(ctx, &ua.CallMethodRequest{ObjectID: obj, MethodID: method, InputArguments: args})
+	if err != nil {
+		return callReply(req, nil, ua.StatusBadCommunicationError, fmt.Errorf("error calling method: %w", err))
+	}
+
+	logging.Logger.Info(fmt.Sprintf("called method %s of object %s on server %s for request %s - status: %s", req.MethodID, req.ObjectID, s.Name, req.CorrelationID, res.StatusCode))
+
+	r := callReply(req, res, res.StatusCode, nil)
+
+	// the names of the outputs are optional, so a failed read only leaves them empty
+	outputs, _ := methodArguments(ctx, o.c, method, "OutputArguments")
+
+	for i, v := range res.OutputArguments {
+		a := handlers.Argument{Datatype: VariantDatatype(v)}
+		if v != nil {
+			a.Value = s.normalize(v.Value())
+		}
+		if i < len(outputs) {
+			a.Name = outputs[i].Name
+		}
+		r.Outputs = append(r.Outputs, a)
+	}
+
+	return r
+}
+
+// callable reports whether the method is on the allowlist of the server, the ids are compared after resolving
+// namespace uris
+func (s *OpcServer) callable(obj, method *ua.NodeID) bool {
+
+	conf := s.config()
+
+	for _, cm := range conf.Callable {
+		m, err := s.parseNodeID(cm.Method)
+		if err != nil {
+			logging.Logger.Warn(fmt.Sprintf("invalid callable method %s: %s", cm.Method, err.Error()), "func", "callable", "server", s.Name)
+			continue
+		}
+		if m.String() != method.String() {
+			continue
+		}
+
+		if cm.Object == "" {
+			return true
+		}
+
+		o, err := s.parseNodeID(cm.Object)
+		if err != nil {
+			logging.Logger.Warn(fmt.Sprintf("invalid callable object %s: %s", cm.Object, err.Error()), "func", "callable", "server", s.Name)
+			continue
+		}
+		if o.String() == obj.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// methodArguments reads the InputArguments or OutputArguments property of a method, a method without the property
+// has no arguments
+func methodArguments(ctx context.Context, c *opcua.Client, method *ua.NodeID, property string) ([]*ua.Argument, error) {
+
+	pid, err := c.Node(method).TranslateBrowsePathsToNodeIDs(ctx, []*ua.QualifiedName{{Name: property}})
+
+	if errors.Is(err, ua.StatusBadNoMatch) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := c.Node(pid).Value(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	eos, _ := v.Value().([]*ua.ExtensionObject)
+
+	args := make([]*ua.Argument, 0, len(eos))
+	for _, eo := range eos {
+		a, ok := eo.Value.(*ua.Argument)
+		if !ok {
+			return nil, fmt.Errorf("%s contains no Argument", property)
+		}
+		args = append(args, a)
+	}
+
+	return args, nil
+}
+
+// callArguments converts the arguments of a request into the variants declared by the method
+func callArguments(decl []*ua.Argument, args []handlers.Argument) ([]*ua.Variant, error) {
+
+	if len(args) != len(decl) {
+		return nil, fmt.Errorf("method expects %d arguments, got %d", len(decl), len(args))
+	}
+
+	vs := make([]*ua.Variant, 0, len(args))
+
+	for i, a := range args {
+		d := decl[i]
+
+		v, err := callArgument(d, a)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d (%s): %w", i, d.Name, err)
+		}
+
+		vs = append(vs, v)
+	}
+
+	return vs, nil
+}
+
+func callArgument(d *ua.Argument, a handlers.Argument) (*ua.Variant, error) {
+
+	// the declared datatype is only enforced for builtin types, subtypes like enumerations are given explicitly
+	declared, _ := builtinType(d.DataType)
+
+	dt := a.Datatype
+	if dt == "" && declared != 0 {
+		dt = id.Name(uint32(declared))
+	}
+
+	t, ok := writeType(dt)
+	switch {
+	case dt == "":
+		return nil, fmt.Errorf("no datatype given for %s", d.DataType)
+	case !ok:
+		return nil, fmt.Errorf("unsupported datatype %s", dt)
+	case declared != 0 && declared != t:
+		return nil, fmt.Errorf("method expects datatype %s, got %s", id.Name(uint32(declared)), dt)
+	}
+
+	values, isArray := a.Value.([]interface{})
+
+	// value ranks: -1 scalar, 0 one or more dimensions, >= 1 fixed number of dimensions, -2 and -3 allow scalars
+	switch {
+	case isArray && d.ValueRank == -1:
+		return nil, errors.New("method expects a scalar")
+	case !isArray && d.ValueRank >= 0:
+		return nil, errors.New("method expects an array")
+	case !isArray:
+		return writeValue(t, a.Value)
+	}
+
+	arr := reflect.MakeSlice(reflect.SliceOf(writeGoTypes[t]), 0, len(values))
+	for _, e := range values {
+		v, err := scalarValue(t, e)
+		if err != nil {
+			return nil, err
+		}
+		arr = reflect.Append(arr, reflect.ValueOf(v))
+	}
+
+	// a Byte array is encoded as ByteString, which servers have to accept for one dimensional Byte arrays
+	return ua.NewVariant(arr.Interface())
+}
+
+// writeGoTypes are the go types of the writable datatypes, they are needed to build arrays
+var writeGoTypes = map[ua.TypeID]reflect.Type{
+	ua.TypeIDBoolean:  reflect.TypeFor[bool](),
+	ua.TypeIDSByte:    reflect.TypeFor[int8](),
+	ua.TypeIDByte:     reflect.TypeFor[uint8](),
+	ua.TypeIDInt16:    reflect.TypeFor[int16](),
+	ua.TypeIDUint16:   reflect.TypeFor[uint16](),
+	ua.TypeIDInt32:    reflect.TypeFor[int32](),
+	ua.TypeIDUint32:   reflect.TypeFor[uint32](),
+	ua.TypeIDInt64:    reflect.TypeFor[int64](),
+	ua.TypeIDUint64:   reflect.TypeFor[uint64](),
+	ua.TypeIDFloat:    reflect.TypeFor[float32](),
+	ua.TypeIDDouble:   reflect.TypeFor[float64](),
+	ua.TypeIDString:   reflect.TypeFor[string](),
+	ua.TypeIDDateTime: reflect.TypeFor[time.Time](),
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"gualogger/handlers"
+	"testing"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestCallArgument(t *testing.T) {
+
+	for _, tc := range []struct {
+		name    string
+		decl    *ua.Argument
+		arg     handlers.Argument
+		want    ua.TypeID
+		wantErr bool
+	}{
+		{
+			name: "declared builtin",
+			decl: &ua.Argument{Name: "speed", DataType: ua.NewNumericNodeID(0, id.Double), ValueRank: -1},
+			arg:  handlers.Argument{Value: json.Number("1.5")},
+			want: ua.TypeIDDouble,
+		},
+		{
+			name:    "mismatching builtin",
+			decl:    &ua.Argument{Name: "speed", DataType: ua.NewNumericNodeID(0, id.Double), ValueRank: -1},
+			arg:     handlers.Argument{Value: json.Number("1"), Datatype: "Int32"},
+			wantErr: true,
+		},
+		{
+			// BaseDataType accepts a value of any type
+			name: "BaseDataType",
+			decl: &ua.Argument{Name: "value", DataType: ua.NewNumericNodeID(0, id.BaseDataType), ValueRank: -1},
+			arg:  handlers.Argument{Value: json.Number("7"), Datatype: "Int32"},
+			want: ua.TypeIDInt32,
+		},
+		{
+			name:    "BaseDataType without datatype",
+			decl:    &ua.Argument{Name: "value", DataType: ua.NewNumericNodeID(0, id.BaseDataType), ValueRank: -1},
+			arg:     handlers.Argument{Value: json.Number("7")},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := callArgument(tc.decl, tc.arg)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Type() != tc.want {
+				t.Fatalf("got variant of type %s, want %s", v.Type(), tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/supervisor"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsConfig holds the settings of the /metrics endpoint
+type MetricsConfig struct {
+	// Connector is added as connector label to all metrics, defaults to $GEIST_CONNECTOR and the hostname
+	Connector string `mapstructure:"connector"`
+}
+
+// connector returns the value of the connector label
+func (m *MetricsConfig) connector() string {
+	if m.Connector != "" {
+		return m.Connector
+	}
+	if c := os.Getenv("GEIST_CONNECTOR"); c != "" {
+		return c
+	}
+	h, _ := os.Hostname()
+	return h
+}
+
+var (
+	dataChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geist_data_changes_total",
+		Help: "Number of values received from the opcua server by node and group.",
+	}, []string{"server", "group", "node"})
+
+	statusValues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geist_status_values_total",
+		Help: "Number of values received with an uncertain or bad status code.",
+	}, []string{"server", "group", "quality", "status"})
+
+	reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geist_reconnect_attempts_total",
+		Help: "Number of connection attempts after the first session of the server.",
+	}, []string{"server"})
+
+	produced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geist_messages_produced_total",
+		Help: "Number of payloads delivered by the exporter.",
+	}, []string{"server", "exporter"})
+
+	produceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geist_produce_errors_total",
+		Help: "Number of payloads the exporter failed to deliver.",
+	}, []string{"server", "exporter"})
+
+	produceLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "geist_produce_latency_seconds",
+		Help:    "Time from handing a payload to the exporter until it is acknowledged.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"server", "exporter"})
+)
+
+// countValue records a value received for the node
+func (s *OpcServer) countValue(key string, id string, q string, status string) {
+
+	s.nodesMu.RLock()
+	var group string
+	if n, ok := s.nodes[key]; ok {
+		group = n.group
+	}
+	s.nodesMu.RUnlock()
+
+	dataChanges.WithLabelValues(s.Name, group, id).Inc()
+
+	if q != handlers.QualityGood {
+		statusValues.WithLabelValues(s.Name, group, q, status).Inc()
+	}
+}
+
+// observe records the delivery result of a payload
+func (w *exportWorker) observe(p handlers.Payload, start time.Time, err error) {
+
+	if err != nil {
+		produceErrors.WithLabelValues(p.Server, w.name).Inc()
+		return
+	}
+
+	produced.WithLabelValues(p.Server, w.name).Inc()
+	produceLatency.WithLabelValues(p.Server, w.name).Observe(time.Since(start).Seconds())
+}
+
+// The queue and the buffer of an exporter are shared by all servers, so their gauges are only labeled by exporter
+var (
+	connectionStateDesc = prometheus.NewDesc("geist_connection_state",
+		"Current connection state of the server, 1 for the active state.", []string{"server", "state"}, nil)
+	keepaliveAgeDesc = prometheus.NewDesc("geist_keepalive_age_seconds",
+		"Seconds since the server last answered a session check or sent a value.", []string{"server"}, nil)
+	queueDepthDesc = prometheus.NewDesc("geist_export_queue_depth",
+		"Number of payloads queued for the exporter.", []string{"exporter"}, nil)
+	bufferDepthDesc = prometheus.NewDesc("geist_buffer_depth",
+		"Number of payloads in the disk buffer of the exporter.", []string{"exporter"}, nil)
+	inFlightDesc = prometheus.NewDesc("geist_export_in_flight",
+		"Number of payloads handed to the exporter and not acknowledged yet.", []string{"exporter"}, nil)
+	droppedDesc = prometheus.NewDesc("geist_export_dropped_total",
+		"Number of payloads dropped by the overflow policy of the exporter.", []string{"exporter"}, nil)
+)
+
+var connectionStates = []supervisor.State{
+	supervisor.StateConnecting,
+	supervisor.StateSubscribed,
+	supervisor.StateDegraded,
+	supervisor.StateReconnecting,
+	supervisor.StateFailed,
+}
+
+// stateCollector reads the gauges of the servers and exporters on every scrape
+type stateCollector struct {
+	sm *ServerManager
+	em *ExportManager
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+
+	for _, s := range c.sm.list() {
+
+		cur := s.sv.State()
+		for _, st := range connectionStates {
+			v := 0.0
+			if st == cur {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(connectionStateDesc, prometheus.GaugeValue, v, s.Name, st.String())
+		}
+
+		if t := s.lastAlive.Load(); t > 0 {
+			ch <- prometheus.MustNewConstMetric(keepaliveAgeDesc, prometheus.GaugeValue, time.Since(time.Unix(0, t)).Seconds(), s.Name)
+		}
+	}
+
+	for _, h := range c.em.Health() {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(h.Queued), h.Name)
+		ch <- prometheus.MustNewConstMetric(bufferDepthDesc, prometheus.GaugeValue, float64(h.Buffered), h.Name)
+		ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(h.InFlight), h.Name)
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(h.Dropped), h.Name)
+	}
+}
+
+// metricsHandler registers all metrics with the connector label and returns the handler of /metrics
+func metricsHandler(mc MetricsConfig, sm *ServerManager, em *ExportManager) (http.Handler, error) {
+
+	reg := prometheus.NewRegistry()
+	wrapped := prometheus.WrapRegistererWith(prometheus.Labels{"connector": mc.connector()}, reg)
+
+	for _, c := range []prometheus.Collector{
+		dataChanges, statusValues, reconnects, produced, produceErrors, produceLatency,
+		stateCollector{sm: sm, em: em},
+	} {
+		if err := wrapped.Register(c); err != nil {
+			return nil, fmt.Errorf("error registering metrics: %w", err)
+		}
+	}
+
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), nil
+}
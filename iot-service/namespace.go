@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/logging"
+	"slices"
+	"strings"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// updateNamespaces reads the NamespaceArray of the server, which is required to resolve node ids in format nsu=<uri>;...
+// If the array changed, the node keys and data types cached with the old indexes are dropped and true is returned
+func (s *OpcServer) updateNamespaces(ctx context.Context, c *opcua.Client) (bool, error) {
+
+	ns, err := c.NamespaceArray(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error reading namespace array: %w", err)
+	}
+
+	s.nsMu.Lock()
+	changed := s.ns != nil && !slices.Equal(s.ns, ns)
+	s.ns = ns
+	s.nsMu.Unlock()
+
+	if changed {
+		logging.Logger.Warn(fmt.Sprintf("namespace array of server %s changed: %v", s.Name, ns), "func", "updateNamespaces")
+		s.invalidateNodes()
+	}
+
+	return changed, nil
+}
+
+// invalidateNodes drops the resolved nodes and data types, so the groups resolve and enrich all nodes again
+func (s *OpcServer) invalidateNodes() {
+
+	s.nodesMu.Lock()
+	clear(s.nodes)
+	clear(s.resolved)
+	s.nodesMu.Unlock()
+
+	s.types.reset()
+}
+
+func (s *OpcServer) namespaces() []string {
+	s.nsMu.RLock()
+	defer s.nsMu.RUnlock()
+	return s.ns
+}
+
+// parseNodeID parses node ids in format ns=<index>;... and nsu=<uri>;..., uris are resolved against the NamespaceArray of the server
+func (s *OpcServer) parseNodeID(id string) (*ua.NodeID, error) {
+
+	if !strings.HasPrefix(id, "nsu=") {
+		return ua.ParseNodeID(id)
+	}
+
+	en, err := ua.ParseExpandedNodeID(id, s.namespaces())
+	if err != nil {
+		return nil, err
+	}
+
+	return en.NodeID, nil
+}
+
+// nodeKey returns the node id in the index based format the server reports it with
+func (s *OpcServer) nodeKey(id string) string {
+	nid, err := s.parseNodeID(id)
+	if err != nil {
+		return id
+	}
+	return nid.String()
+}
+
+// stableID returns the node id with the namespace uri instead of the index, so it does not change if the server reorders its namespaces
+// Nodes of namespace 0 keep their short form
+func (s *OpcServer) stableID(nid *ua.NodeID) string {
+
+	id := nid.String()
+	ns := s.namespaces()
+
+	if nid.Namespace() == 0 || int(nid.Namespace()) >= len(ns) {
+		return id
+	}
+
+	_, rest, ok := strings.Cut(id, ";")
+	if !ok {
+		return id
+	}
+
+	return "nsu=" + ns[nid.Namespace()] + ";" + rest
+}
@@ -5,101 +5,229 @@ import (
 	"fmt"
 	"gualogger/handlers"
 	"gualogger/logging"
+	"gualogger/supervisor"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
 	"github.com/gopcua/opcua/monitor"
 	"github.com/gopcua/opcua/ua"
 )
 
-var (
-	last_keepalive      time.Time
-	con_active          bool
-	retry_count         int
-	current_retry_count = 0
-	Subs                map[uint32]*monitor.Subscription
-	current_client      *opcua.Client
-	nodeToTopics        map[string][]string
-)
+// OpcServer holds the runtime state of a single named opcua connection
+type OpcServer struct {
+	Name string
+
+	// conf is replaced on configuration changes, sess is the session of the current connection
+	confMu sync.RWMutex
+	conf   OpcConfig
+	sessMu sync.Mutex
+	sess   *opcSession
+
+	sv     *supervisor.Supervisor
+	revive chan struct{}
+	subs   map[uint32]activeSub
+	subsMu sync.Mutex
+
+	// lastData is the time of the last published value in unix nanoseconds
+	lastData atomic.Int64
+	// lastAlive is the time the server last answered a session check or sent a value in unix nanoseconds
+	lastAlive atomic.Int64
+	connects  atomic.Int64
+
+	// cert is the application certificate of the current session, nil without security
+	cert atomic.Pointer[[]byte]
+
+	nsMu sync.RWMutex
+	ns   []string
+
+	nodesMu  sync.RWMutex
+	nodes    map[string]*nodeInfo
+	resolved map[string][]Nodeid
+
+	types *typeCache
+}
+
+func NewOpcServer(o OpcConfig) *OpcServer {
+
+	s := &OpcServer{
+		Name:     o.Name,
+		conf:     o,
+		subs:     make(map[uint32]activeSub),
+		nodes:    make(map[string]*nodeInfo),
+		resolved: make(map[string][]Nodeid),
+		types:    newTypeCache(),
+		revive:   make(chan struct{}, 1),
+	}
+
+	s.sv = supervisor.New(supervisorConfig(o), s.connect)
+
+	return s
+}
+
+func supervisorConfig(o OpcConfig) supervisor.Config {
+	return supervisor.Config{
+		Name:            o.Name,
+		Retries:         o.Connection.Retries,
+		Backoff:         o.Connection.Backoff,
+		CheckInterval:   o.Connection.keepaliveInterval(),
+		DegradedTimeout: o.Connection.degradedTimeout(),
+	}
+}
+
+// publish tags the payload with the name of the connection and hands it to the export manager
+func (s *OpcServer) publish(ctx context.Context, p handlers.Payload) {
+	now := time.Now().UnixNano()
+	s.lastData.Store(now)
+	s.lastAlive.Store(now)
+	p.Server = s.Name
+	mgr.Publish(ctx, p)
+}
+
+// InitSuperVisor connects to the server and keeps the session alive until ctx is done
+// If the retries are exceeded, the server stays failed until a configuration change revives it
+func (s *OpcServer) InitSuperVisor(ctx context.Context) {
+
+	go s.renewCertificate(ctx)
 
-func (o *OpcConfig) InitSuperVisor(ctx context.Context) {
+	for {
+		err := s.sv.Run(ctx)
+		if err == nil {
+			return
+		}
+
+		logging.Logger.Error(fmt.Sprintf("giving up connection to server %s: %s", s.Name, err.Error()), "func", "InitSuperVisor", "server", s.Name)
 
-	retry_count = o.Connection.Retries
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.revive:
+			logging.Logger.Info(fmt.Sprintf("configuration of failed server %s changed - connecting again", s.Name))
+		}
+	}
+}
 
-	Subs = make(map[uint32]*monitor.Subscription)
-	nodeToTopics = make(map[string][]string)
+// connect creates a client and starts all groups and event subscriptions of the server, they are stopped when ctx is done
+func (s *OpcServer) connect(ctx context.Context, states chan<- opcua.ConnState) (supervisor.Session, error) {
 
-	for _, n := range o.Subscription.Nodeids {
-		nodeToTopics[n.Id] = n.Topics
+	if s.connects.Add(1) > 1 {
+		reconnects.WithLabelValues(s.Name).Inc()
 	}
 
-	c, err := o.Connection.CreateClient(ctx)
+	c, err := s.CreateClient(ctx, states)
 
 	if err != nil {
-		logging.Logger.Error(err.Error(), "func", "InitSuperVisor")
-		return
+		return nil, err
 	}
 
-	logging.Logger.Info(fmt.Sprintf("successfully connected to opcua on endpoint %s:%d", o.Connection.Endpoint, o.Connection.Port))
+	m, err := monitor.NewNodeMonitor(c)
 
-	subctx, cancel := context.WithCancel(ctx)
+	if err != nil {
+		c.Close(ctx)
+		return nil, fmt.Errorf("error while creating node monitor: %w", err)
+	}
 
-	if err := InitSubs(c, ctx, subctx, &o.Subscription.Nodeids, o.Subscription.Interval); err != nil {
-		logging.Logger.Error(fmt.Sprintf("error while creating node monitor: %s", err.Error()), "func", "InitSuperVisor")
-		return
+	o := &opcSession{
+		s:      s,
+		ctx:    ctx,
+		c:      c,
+		m:      m,
+		groups: make(map[string]*runningGroup),
+		events: make(map[string]*runningEvents),
 	}
 
-	con_active = true
+	// the session is registered with the groups of the current configuration at once, so no change is missed
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
 
-	for {
+	conf := s.config()
 
-		time.Sleep(3 * time.Duration(o.Subscription.Interval))
+	logging.Logger.Info(fmt.Sprintf("successfully connected to opcua server %s on endpoint %s:%d", s.Name, conf.Connection.Endpoint, conf.Connection.Port))
 
-		if time.Since(last_keepalive) > time.Duration(6*o.Subscription.Interval)*time.Second {
+	s.InitSubs(o, conf.SubscriptionGroups(), conf.Events)
+	s.sess = o
 
-			current_retry_count++
+	return o, nil
+}
 
-			if retry_count < current_retry_count {
+// opcSession is the supervised session of a client with the groups and event subscriptions running on it
+type opcSession struct {
+	s      *OpcServer
+	ctx    context.Context
+	c      *opcua.Client
+	m      *monitor.NodeMonitor
+	groups map[string]*runningGroup
+	events map[string]*runningEvents
+
+	// wg tracks the goroutines of all groups and event subscriptions of the session
+	wg sync.WaitGroup
+}
 
-				logging.Logger.Warn(fmt.Sprintf("maximum number of %d retries exceeded- shutting down", retry_count), "func", "InitSuperVisor")
-				cancel()
-				ctx.Done()
-				break
-			}
+// Check reads the state of the server, the session is only healthy while the server is running
+func (o *opcSession) Check(ctx context.Context) error {
 
-			con_active = false
+	v, err := o.c.Node(ua.NewNumericNodeID(0, id.Server_ServerStatus_State)).Value(ctx)
 
-			logging.Logger.Warn(fmt.Sprintf("received last keepalive over %d seconds ago attempting retry attempt %d/%d", 60, current_retry_count, retry_count), "func", "InitSuperVisor")
+	if err != nil {
+		return err
+	}
 
-			if con_active {
-				cancel()
-				c.Close(ctx)
-			}
+	if st, ok := v.Value().(int32); ok && ua.ServerState(st) != ua.ServerStateRunning {
+		return fmt.Errorf("server state is %s", ua.ServerState(st))
+	}
 
-			c, err = o.Connection.CreateClient(ctx)
+	o.s.lastAlive.Store(time.Now().UnixNano())
+	return nil
+}
 
-			if err != nil {
-				logging.Logger.Error(err.Error(), "func", "InitSuperVisor")
-				continue
-			}
+// Reconnected reads the NamespaceArray again after the client reconnected. All node ids of the session were resolved
+// with the old namespace indexes, so the session is restarted if the server changed them
+func (o *opcSession) Reconnected(ctx context.Context) bool {
 
-			subctx, cancel = context.WithCancel(ctx)
+	changed, err := o.s.updateNamespaces(ctx, o.c)
+	if err != nil {
+		logging.Logger.Warn(err.Error(), "func", "Reconnected", "server", o.s.Name)
+		return false
+	}
 
-			if err := InitSubs(c, ctx, subctx, &o.Subscription.Nodeids, o.Subscription.Interval); err != nil {
-				logging.Logger.Error(fmt.Sprintf("error while creating node monitor: %s", err.Error()), "func", "InitSuperVisor")
-				continue
-			}
-			logging.Logger.Info("connection retry successful")
-			con_active = true
-			current_retry_count = 0
-		}
+	return changed
+}
+
+// Close waits for the groups to delete their subscriptions on the server and closes the client afterwards
+// The groups stop as soon as the context of the session is done, so Close is called after it was cancelled
+func (o *opcSession) Close(ctx context.Context) error {
 
+	// once the session is detached from the server, no reload starts further groups on it
+	o.s.sessMu.Lock()
+	if o.s.sess == o {
+		o.s.sess = nil
+	}
+	o.s.sessMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logging.Logger.Warn(fmt.Sprintf("subscriptions of server %s not deleted before closing the session", o.s.Name), "func", "Close", "server", o.s.Name)
 	}
 
+	return o.c.Close(ctx)
 }
 
-func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error) {
+// CreateClient connects a new client to the server, its connection state changes are sent to states
+func (s *OpcServer) CreateClient(ctx context.Context, states chan<- opcua.ConnState) (*opcua.Client, error) {
 
+	conf := s.config()
+	c := &conf.Connection
 	con_string := fmt.Sprintf("opc.tcp://%s:%d", c.Endpoint, c.Port)
 
 	eps, err := opcua.GetEndpoints(ctx, con_string)
@@ -112,7 +240,7 @@ func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error)
 		return nil, fmt.Errorf("no endpoints found - check configuration")
 	}
 
-	ep, err := opcua.SelectEndpoint(eps, c.Policy, ua.MessageSecurityModeFromString(c.Mode))
+	ep, err := selectEndpoint(eps, c.Policy, ua.MessageSecurityModeFromString(c.Mode), c.Authentication.userTokenType())
 
 	if err != nil {
 		return nil, err
@@ -120,8 +248,11 @@ func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error)
 
 	opts := []opcua.Option{
 		opcua.ApplicationName("geist"),
+		// a loaded certificate replaces the ApplicationURI with the one it contains
+		opcua.ApplicationURI(c.Certificate.applicationURI()),
 		opcua.AutoReconnect(true),
 		opcua.ReconnectInterval(10 * time.Second),
+		opcua.StateChangedCh(states),
 		opcua.SecurityPolicy(c.Policy),
 		opcua.SecurityMode(ua.MessageSecurityModeFromString(c.Mode)),
 	}
@@ -133,22 +264,39 @@ func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error)
 		opts = append(opts, opcua.SecurityFromEndpoint(ep, ua.UserTokenTypeUserName))
 
 	case "Certificate":
-	// Cert Config goes here, but has to be evaluated first
+		cert, key, err := loadKeyPair(c.Authentication.userCertificate(c.Certificate.dir()))
+
+		if err != nil {
+			return nil, fmt.Errorf("error loading user certificate: %w", err)
+		}
+
+		opts = append(opts, opcua.AuthCertificate(cert), opcua.AuthPrivateKey(key))
+		opts = append(opts, opcua.SecurityFromEndpoint(ep, ua.UserTokenTypeCertificate))
 
 	default:
 		opts = append(opts, opcua.AuthAnonymous())
 		opts = append(opts, opcua.SecurityFromEndpoint(ep, ua.UserTokenTypeAnonymous))
 	}
 
+	s.cert.Store(nil)
+
 	if c.Policy != "None" {
-		if c.Certificate.AutoCreate {
-			if err := CreateKeyPair(); err != nil {
-				return nil, err
-			}
+		cert, key, err := ensureKeyPair(&c.Certificate)
+
+		if err != nil {
+			return nil, err
 		}
 
-		opts = append(opts, opcua.CertificateFile("./certs/cert.pem"))
-		opts = append(opts, opcua.PrivateKeyFile("./certs/key.pem"))
+		opts = append(opts, opcua.Certificate(cert), opcua.PrivateKey(key))
+		s.cert.Store(&cert)
+
+		if c.Certificate.PKI != "" {
+			if err := newPKI(c.Certificate.PKI).validate(ep.ServerCertificate); err != nil {
+				return nil, fmt.Errorf("server certificate of %s rejected: %w", s.Name, err)
+			}
+		} else {
+			logging.Logger.Warn(fmt.Sprintf("server certificate of %s is not validated - set a pki_directory to validate it", s.Name), "func", "CreateClient", "server", s.Name)
+		}
 	}
 
 	client, err := opcua.NewClient(con_string, opts...)
@@ -161,95 +309,270 @@ func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error)
 		return nil, err
 	}
 
-	current_client = client
+	if _, err := s.updateNamespaces(ctx, client); err != nil {
+		client.Close(ctx)
+		return nil, err
+	}
+
 	return client, nil
 
 }
 
-func InitSubs(c *opcua.Client, pctx context.Context, ctx context.Context, ids *[]Nodeid, iv int) error {
-	m, err := monitor.NewNodeMonitor(c)
+// selectEndpoint selects the endpoint with the highest security level matching the policy and mode, which accepts
+// user identity tokens of the given type
+func selectEndpoint(eps []*ua.EndpointDescription, policy string, mode ua.MessageSecurityMode, token ua.UserTokenType) (*ua.EndpointDescription, error) {
 
-	if err != nil {
+	var accepting []*ua.EndpointDescription
 
-		return err
+	for _, ep := range eps {
+		for _, t := range ep.UserIdentityTokens {
+			if t.TokenType == token {
+				accepting = append(accepting, ep)
+				break
+			}
+		}
 	}
 
-	go CreateSubscription(pctx, ctx, m, ids, iv)
+	if len(accepting) == 0 {
+		return nil, fmt.Errorf("no endpoint accepts user tokens of type %s", token)
+	}
 
-	time.Sleep(10 * time.Second)
-	return nil
+	ep, err := opcua.SelectEndpoint(accepting, policy, mode)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w accepting user tokens of type %s", err, token)
+	}
+
+	return ep, nil
+}
+
+// InitSubs creates one subscription per group and event subscription, which run until the session is closed
+func (s *OpcServer) InitSubs(o *opcSession, groups []Subscription, events []EventSubscription) {
+
+	for _, g := range groups {
+		s.startGroup(o, g)
+	}
+
+	for _, e := range events {
+		s.startEvents(o, e)
+	}
 }
 
-func CreateSubscription(pctx context.Context, ctx context.Context, m *monitor.NodeMonitor, ids *[]Nodeid, iv int) {
+// CreateSubscription resolves the nodes of the group and monitors them until ctx is done
+// If a resolve interval is set, the selectors are resolved again periodically and the monitored items are updated
+func (s *OpcServer) CreateSubscription(ctx context.Context, c *opcua.Client, m *monitor.NodeMonitor, g Subscription, update <-chan Subscription) {
+
+	sel := g
+	g, _, _, _ = s.resolveGroup(ctx, c, sel)
+	s.loadTypes(ctx, c, g.Nodeids)
 
-	sub, err := m.Subscribe(pctx, &opcua.SubscriptionParameters{Interval: time.Duration(iv) * time.Second},
-		func(s *monitor.Subscription, dcm *monitor.DataChangeMessage) {
+	if g.Enrich {
+		s.enrich(ctx, c, g.Nodeids)
+	}
+
+	params := &opcua.SubscriptionParameters{
+		Interval:          g.publishingInterval(),
+		LifetimeCount:     g.LifetimeCount,
+		MaxKeepAliveCount: g.MaxKeepAliveCount,
+		Priority:          g.Priority,
+	}
+
+	sub, err := m.Subscribe(ctx, params,
+		func(_ *monitor.Subscription, dcm *monitor.DataChangeMessage) {
 			if dcm.Error != nil {
 				logging.Logger.Error(fmt.Sprintf("error with received sub message: %s - nodeid %s", dcm.Error.Error(), dcm.NodeID))
-			} else if dcm.Status != ua.StatusOK {
-				logging.Logger.Error(fmt.Sprintf("received bad status for sub message: %s - nodeid %s", dcm.Status, dcm.NodeID))
-			} else {
-
-				dt := DeferDatatype(dcm.DataValue.Value.Value())
-
-				if dcm.NodeID.String() == "i=2258" {
-					last_keepalive = time.Now()
-				} else {
-					p := handlers.Payload{
-						Value:    dcm.Value.Value(),
-						TS:       dcm.SourceTimestamp,
-						Name:     dcm.NodeID.StringID(),
-						Id:       dcm.NodeID.String(),
-						Datatype: dt,
-						Topics:   nodeToTopics[dcm.NodeID.String()],
-					}
-
-					go mgr.Publish(ctx, p)
-
+			} else if p, ok := s.valuePayload(dcm.NodeID, dcm.DataValue); ok {
+				if dcm.Status != ua.StatusOK {
+					logging.Logger.Debug(fmt.Sprintf("received status %s for sub message - nodeid %s", p.Status, dcm.NodeID))
 				}
-
+				s.publish(ctx, p)
 			}
-
 		})
 
 	if err != nil {
-		logging.Logger.Error(fmt.Sprintf("error while creating subscription: %s", err.Error()))
+		logging.Logger.Error(fmt.Sprintf("error while creating subscription %s: %s", g.Name, err.Error()))
 		return
 	}
 
-	for _, n := range *ids {
-		_, err := sub.AddMonitorItems(ctx, monitor.Request{NodeID: ua.MustParseNodeID(n.Id), MonitoringMode: ua.MonitoringModeReporting, MonitoringParameters: &ua.MonitoringParameters{DiscardOldest: true, QueueSize: 1}})
+	s.monitorNodes(ctx, sub, g.Nodeids)
+
+	id := sub.SubscriptionID()
+	s.subsMu.Lock()
+	s.subs[id] = activeSub{group: g.Name, sub: sub}
+	s.subsMu.Unlock()
+
+	logging.Logger.Info(fmt.Sprintf("successfully initialized subscription %s on server %s with id:%d - interval: %s", g.Name, s.Name, id, params.Interval))
+
+	// the session is still open while the groups stop, so the subscription is deleted on the server
+	defer s.TerminateSub(context.WithoutCancel(ctx), sub, id)
+
+	var tick <-chan time.Time
+	if ri := sel.resolveInterval(); ri > 0 {
+		t := time.NewTicker(ri)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case sel = <-update:
+			logging.Logger.Info(fmt.Sprintf("applying changed nodes of subscription %s on server %s", g.Name, s.Name))
+		}
+
+		_, added, modified, removed := s.resolveGroup(ctx, c, sel)
+		s.loadTypes(ctx, c, added)
+
+		if sel.Enrich {
+			s.enrich(ctx, c, added)
+		}
+
+		if len(removed) > 0 {
+			ids := make([]*ua.NodeID, 0, len(removed))
+			for _, r := range removed {
+				if nid, err := s.parseNodeID(r); err == nil {
+					ids = append(ids, nid)
+				}
+			}
+			if err := sub.RemoveNodeIDs(ctx, ids...); err != nil {
+				logging.Logger.Error(fmt.Sprintf("error removing subscription items: %s", err.Error()))
+			}
+		}
+
+		s.monitorNodes(ctx, sub, added)
+		s.modifyNodes(ctx, sub, modified)
+	}
+}
+
+func (s *OpcServer) monitorNodes(ctx context.Context, sub *monitor.Subscription, nodes []Nodeid) {
+
+	for _, n := range nodes {
+		mp, err := n.MonitoringParameters()
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("invalid monitoring parameters for nodeid %s: %s", n.Id, err.Error()))
+			continue
+		}
+
+		nid, err := s.parseNodeID(n.Id)
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("error parsing node id %s: %s", n.Id, err.Error()))
+			continue
+		}
+
+		_, err = sub.AddMonitorItems(ctx, monitor.Request{NodeID: nid, MonitoringMode: ua.MonitoringModeReporting, MonitoringParameters: mp})
 
 		if err != nil {
 			logging.Logger.Error(fmt.Sprintf("error adding subscription item: %s", err.Error()))
 			continue
 		}
 	}
+}
 
-	_, err = sub.AddMonitorItems(ctx, monitor.Request{NodeID: ua.MustParseNodeID("i=2258"), MonitoringMode: ua.MonitoringModeReporting, MonitoringParameters: &ua.MonitoringParameters{DiscardOldest: true, QueueSize: 1}})
+// modifyNodes applies changed monitoring parameters to the monitored items of the nodes
+func (s *OpcServer) modifyNodes(ctx context.Context, sub *monitor.Subscription, nodes []Nodeid) {
 
-	if err != nil {
-		logging.Logger.Error(fmt.Sprintf("error adding subscription item: %s", err.Error()))
+	reqs := make([]monitor.Request, 0, len(nodes))
+
+	for _, n := range nodes {
+		mp, err := n.MonitoringParameters()
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("invalid monitoring parameters for nodeid %s: %s", n.Id, err.Error()))
+			continue
+		}
+
+		nid, err := s.parseNodeID(n.Id)
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("error parsing node id %s: %s", n.Id, err.Error()))
+			continue
+		}
+
+		reqs = append(reqs, monitor.Request{NodeID: nid, MonitoringMode: ua.MonitoringModeReporting, MonitoringParameters: mp})
+	}
+
+	if len(reqs) == 0 {
 		return
 	}
 
-	id := sub.SubscriptionID()
-	Subs[id] = sub
+	if err := sub.ModifyMonitorItems(ctx, reqs...); err != nil {
+		logging.Logger.Error(fmt.Sprintf("error modifying subscription items: %s", err.Error()))
+	}
+}
+
+// sameMonitoring reports whether both nodes are monitored with the same parameters
+func (n *Nodeid) sameMonitoring(o Nodeid) bool {
+	return n.SamplingInterval == o.SamplingInterval && n.QueueSize == o.QueueSize && n.DiscardPolicy == o.DiscardPolicy &&
+		n.Trigger == o.Trigger && n.Deadband == o.Deadband
+}
+
+// MonitoringParameters builds the monitoring parameters of a node, a DataChangeFilter is only attached if a trigger or deadband is configured
+func (n *Nodeid) MonitoringParameters() (*ua.MonitoringParameters, error) {
+
+	mp := &ua.MonitoringParameters{
+		SamplingInterval: n.SamplingInterval,
+		QueueSize:        n.QueueSize,
+		DiscardOldest:    true,
+	}
+
+	if mp.QueueSize == 0 {
+		mp.QueueSize = 1
+	}
+
+	switch n.DiscardPolicy {
+	case "", "oldest":
+	case "newest":
+		mp.DiscardOldest = false
+	default:
+		return nil, fmt.Errorf("unknown discard policy %q", n.DiscardPolicy)
+	}
+
+	if n.Trigger == "" && (n.Deadband.Type == "" || n.Deadband.Type == "none") {
+		return mp, nil
+	}
 
-	logging.Logger.Info(fmt.Sprintf("successfully initialized subscription with id:%d", id))
+	f := &ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValue, DeadbandType: uint32(ua.DeadbandTypeNone)}
 
-	defer TerminateSub(pctx, sub, id)
-	<-ctx.Done()
+	switch n.Trigger {
+	case "", "status_value":
+	case "status":
+		f.Trigger = ua.DataChangeTriggerStatus
+	case "status_value_timestamp":
+		f.Trigger = ua.DataChangeTriggerStatusValueTimestamp
+	default:
+		return nil, fmt.Errorf("unknown trigger %q", n.Trigger)
+	}
+
+	switch n.Deadband.Type {
+	case "", "none":
+	case "absolute":
+		f.DeadbandType = uint32(ua.DeadbandTypeAbsolute)
+		f.DeadbandValue = n.Deadband.Value
+	case "percent":
+		if n.Deadband.Value > 100 {
+			return nil, fmt.Errorf("percent deadband must be between 0 and 100, got %v", n.Deadband.Value)
+		}
+		f.DeadbandType = uint32(ua.DeadbandTypePercent)
+		f.DeadbandValue = n.Deadband.Value
+	default:
+		return nil, fmt.Errorf("unknown deadband type %q", n.Deadband.Type)
+	}
+
+	mp.Filter = ua.NewExtensionObject(f)
+	return mp, nil
 }
 
-func TerminateSub(ctx context.Context, s *monitor.Subscription, id uint32) {
+func (s *OpcServer) TerminateSub(ctx context.Context, sub *monitor.Subscription, id uint32) {
 
-	logging.Logger.Warn(fmt.Sprintf("terminating subscription with id: %d - delivered: %d - dropped: %d", id, s.Delivered(), s.Dropped()))
-	delete(Subs, id)
-	s.Unsubscribe(ctx)
+	logging.Logger.Warn(fmt.Sprintf("terminating subscription with id: %d on server %s - delivered: %d - dropped: %d", id, s.Name, sub.Delivered(), sub.Dropped()))
+	s.subsMu.Lock()
+	delete(s.subs, id)
+	s.subsMu.Unlock()
+	sub.Unsubscribe(ctx)
 
 }
 
+// DeferDatatype returns the datatype label of a go value as published with the payload
 func DeferDatatype(i interface{}) string {
 	var dt string
 	switch i.(type) {
@@ -261,6 +584,8 @@ func DeferDatatype(i interface{}) string {
 		dt = "u16"
 	case uint32:
 		dt = "u32"
+	case uint64:
+		dt = "u64"
 	case int8:
 		dt = "i8"
 	case int16:
@@ -275,6 +600,32 @@ func DeferDatatype(i interface{}) string {
 		dt = "f64"
 	case bool:
 		dt = "Bool"
+	case time.Time:
+		dt = "DateTime"
+	case []byte:
+		dt = "Bytes"
+	case *ua.LocalizedText:
+		dt = "LocalizedText"
+	case *ua.QualifiedName:
+		dt = "QualifiedName"
+	case *ua.NodeID:
+		dt = "NodeId"
+	case *ua.ExpandedNodeID:
+		dt = "ExpandedNodeId"
+	case *ua.GUID:
+		dt = "Guid"
+	case ua.StatusCode:
+		dt = "StatusCode"
+	case ua.XMLElement, *ua.XMLElement:
+		dt = "XmlElement"
+	case *ua.ExtensionObject:
+		dt = "Structure"
+	case *ua.DataValue:
+		dt = "DataValue"
+	case *ua.Variant:
+		dt = "Variant"
+	case nil:
+		dt = "Null"
 	default:
 		dt = "Str"
 
@@ -282,43 +633,60 @@ func DeferDatatype(i interface{}) string {
 	return dt
 }
 
-// func Read(ctx context.Context) []handlers.Payload {
-
-// 	pay := make([]handlers.Payload, 0)
-// 	nodes := make([]*ua.ReadValueID, 0)
-
-// 	if !con_active {
-// 		return pay
-// 	}
-
-// 	for _, n := range conf.Opcua.Subscription.Nodeids {
-
-// 		id, err := ua.ParseNodeID(n.Id)
-
-// 		if err != nil {
-// 			logging.Logger.Error(fmt.Sprintf("error parsing node id while reading:%s", err.Error()), "func", "read")
-// 			continue
-// 		}
-
-// 		nodes = append(nodes, &ua.ReadValueID{NodeID: id})
-// 	}
-
-// 	res, err := current_client.Read(ctx, &ua.ReadRequest{NodesToRead: nodes})
+// variantDatatypes maps the builtin types of opc ua to the datatype labels of the payload
+var variantDatatypes = map[ua.TypeID]string{
+	ua.TypeIDBoolean:         "Bool",
+	ua.TypeIDSByte:           "i8",
+	ua.TypeIDByte:            "u8",
+	ua.TypeIDInt16:           "i16",
+	ua.TypeIDUint16:          "u16",
+	ua.TypeIDInt32:           "i32",
+	ua.TypeIDUint32:          "u32",
+	ua.TypeIDInt64:           "i64",
+	ua.TypeIDUint64:          "u64",
+	ua.TypeIDFloat:           "f32",
+	ua.TypeIDDouble:          "f64",
+	ua.TypeIDString:          "Str",
+	ua.TypeIDDateTime:        "DateTime",
+	ua.TypeIDGUID:            "Guid",
+	ua.TypeIDByteString:      "Bytes",
+	ua.TypeIDXMLElement:      "XmlElement",
+	ua.TypeIDNodeID:          "NodeId",
+	ua.TypeIDExpandedNodeID:  "ExpandedNodeId",
+	ua.TypeIDStatusCode:      "StatusCode",
+	ua.TypeIDQualifiedName:   "QualifiedName",
+	ua.TypeIDLocalizedText:   "LocalizedText",
+	ua.TypeIDExtensionObject: "Structure",
+	ua.TypeIDDataValue:       "DataValue",
+	ua.TypeIDVariant:         "Variant",
+	ua.TypeIDDiagnosticInfo:  "DiagnosticInfo",
+}
 
-// 	if err != nil {
-// 		logging.Logger.Error(fmt.Sprintf("error occured during opc ua read request:%s", err.Error()), "func", "read")
-// 		return pay
-// 	}
+// VariantDatatype returns the datatype label of a variant, arrays are suffixed with their dimensions, e.g. f64[2,3]
+func VariantDatatype(v *ua.Variant) string {
 
-// 	for _, r := range res.Results {
-// 		dt := DeferDatatype(r.Value.Value())
+	if v == nil || v.Type() == ua.TypeIDNull {
+		return "Null"
+	}
 
-// 		p := handlers.Payload{Value: r.Value.Value(), TS: r.SourceTimestamp, Name: "", Id: "", Datatype: dt}
+	dt, ok := variantDatatypes[v.Type()]
+	if !ok {
+		dt = DeferDatatype(v.Value())
+	}
 
-// 		pay = append(pay, p)
+	if !v.Has(ua.VariantArrayValues) {
+		return dt
+	}
 
-// 	}
+	dims := v.ArrayDimensions()
+	if len(dims) == 0 {
+		dims = []int32{v.ArrayLength()}
+	}
 
-// 	return pay
+	parts := make([]string, len(dims))
+	for i, d := range dims {
+		parts[i] = strconv.Itoa(int(d))
+	}
 
-// }
+	return dt + "[" + strings.Join(parts, ",") + "]"
+}
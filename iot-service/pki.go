@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gualogger/logging"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// pki is a directory with the OPC UA certificate store layout
+//
+//	own/certs, own/private    application certificate and key
+//	trusted/certs             trusted server certificates and CAs
+//	trusted/crl               revocation lists of the trusted CAs
+//	issuers/certs             CAs which are only used to build chains
+//	issuers/crl               revocation lists of the issuers
+//	rejected/certs            rejected server certificates, move them to trusted/certs to approve them
+//
+// The directories are read on every validation, so approved certificates are used on the next connection attempt
+type pki struct {
+	dir string
+}
+
+func newPKI(dir string) *pki {
+	return &pki{dir: dir}
+}
+
+func (p *pki) path(elem ...string) string {
+	return filepath.Join(append([]string{p.dir}, elem...)...)
+}
+
+// validate verifies the DER encoded server certificate against the trust list, rejected certificates are saved to
+// rejected/certs
+func (p *pki) validate(der []byte) error {
+
+	if len(der) == 0 {
+		return errors.New("server sent no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("error parsing certificate: %w", err)
+	}
+
+	if err := p.verify(cert); err != nil {
+		p.reject(cert)
+		return err
+	}
+
+	return nil
+}
+
+func (p *pki) verify(cert *x509.Certificate) error {
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate is only valid from %s to %s", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+
+	trusted, err := loadCerts(p.path("trusted", "certs"))
+	if err != nil {
+		return err
+	}
+
+	issuers, err := loadCerts(p.path("issuers", "certs"))
+	if err != nil {
+		return err
+	}
+
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, c := range trusted {
+		roots.AddCert(c)
+	}
+	for _, c := range issuers {
+		intermediates.AddCert(c)
+	}
+
+	// the hostname is not verified, servers are commonly reached by addresses missing in their certificate
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	if err != nil {
+		// a certificate in the trust list is accepted as it is, even if Verify rejects its extensions
+		for _, c := range trusted {
+			if bytes.Equal(c.Raw, cert.Raw) {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate is not trusted: %w", err)
+	}
+
+	crls, err := loadCRLs(p.path("trusted", "crl"), p.path("issuers", "crl"))
+	if err != nil {
+		return err
+	}
+
+	for _, chain := range chains {
+		if err := revoked(chain, crls); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revoked checks every certificate of the chain against the revocation lists of its issuer
+func revoked(chain []*x509.Certificate, crls []*x509.RevocationList) error {
+
+	for i := 0; i < len(chain)-1; i++ {
+		c, issuer := chain[i], chain[i+1]
+
+		for _, crl := range crls {
+			if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+
+			for _, e := range crl.RevokedCertificateEntries {
+				if e.SerialNumber.Cmp(c.SerialNumber) == 0 {
+					return fmt.Errorf("certificate %s was revoked on %s", c.Subject.CommonName, e.RevocationTime.Format(time.RFC3339))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// reject saves the certificate to rejected/certs named after its common name and thumbprint
+func (p *pki) reject(cert *x509.Certificate) {
+
+	cn := unsafeName.ReplaceAllString(cert.Subject.CommonName, "_")
+	if cn == "" {
+		cn = "server"
+	}
+
+	thumb := sha1.Sum(cert.Raw)
+	name := fmt.Sprintf("%s [%s].der", cn, hex.EncodeToString(thumb[:]))
+
+	dir := p.path("rejected", "certs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logging.Logger.Error(fmt.Sprintf("error creating %s: %s", dir, err.Error()), "func", "reject")
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, cert.Raw, 0644); err != nil {
+		logging.Logger.Error(fmt.Sprintf("error saving rejected certificate: %s", err.Error()), "func", "reject")
+		return
+	}
+
+	logging.Logger.Warn(fmt.Sprintf("rejected server certificate %s saved to %s - move it to %s to trust it", cert.Subject.CommonName, path, p.path("trusted", "certs")), "func", "reject")
+}
+
+// loadCerts reads all PEM or DER encoded certificates of a directory, a missing directory is empty
+func loadCerts(dir string) ([]*x509.Certificate, error) {
+
+	var certs []*x509.Certificate
+
+	err := readDir(dir, func(name string, b []byte) error {
+		for _, der := range decodePEM(b, "CERTIFICATE") {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				return fmt.Errorf("error parsing certificate %s: %w", name, err)
+			}
+			certs = append(certs, c)
+		}
+		return nil
+	})
+
+	return certs, err
+}
+
+// loadCRLs reads all PEM or DER encoded revocation lists of the directories
+func loadCRLs(dirs ...string) ([]*x509.RevocationList, error) {
+
+	var crls []*x509.RevocationList
+
+	for _, dir := range dirs {
+		err := readDir(dir, func(name string, b []byte) error {
+			for _, der := range decodePEM(b, "X509 CRL") {
+				crl, err := x509.ParseRevocationList(der)
+				if err != nil {
+					return fmt.Errorf("error parsing revocation list %s: %w", name, err)
+				}
+				crls = append(crls, crl)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return crls, nil
+}
+
+func readDir(dir string, fn func(name string, b []byte) error) error {
+
+	entries, err := os.ReadDir(dir)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(path, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodePEM returns the DER bytes of all PEM blocks of the given type, data without PEM blocks is returned as it is
+func decodePEM(b []byte, typ string) [][]byte {
+
+	var ders [][]byte
+	found := false
+
+	for rest := b; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+
+		if block == nil {
+			break
+		}
+
+		found = true
+		if block.Type == typ {
+			ders = append(ders, block.Bytes)
+		}
+	}
+
+	if !found {
+		return [][]byte{b}
+	}
+
+	return ders
+}
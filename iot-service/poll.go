@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/logging"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+const (
+	ModeSubscription = "subscription"
+	ModePoll         = "poll"
+)
+
+// PollGroup periodically reads all nodes of the group until ctx is done
+// The reads are split into chunks of the MaxNodesPerRead limit of the server
+// Changed nodes of the group are received on update and read from the next poll on
+func (s *OpcServer) PollGroup(ctx context.Context, c *opcua.Client, g Subscription, update <-chan Subscription) {
+
+	sel := g
+	g, _, _, _ = s.resolveGroup(ctx, c, sel)
+	s.loadTypes(ctx, c, g.Nodeids)
+	nodes := s.readValueIDs(g.Nodeids)
+
+	if g.Enrich {
+		s.enrich(ctx, c, g.Nodeids)
+	}
+
+	limit := maxNodesPerRead(ctx, c)
+	chunk := limit
+	if chunk <= 0 || chunk > len(nodes) {
+		chunk = len(nodes)
+	}
+
+	iv := g.publishingInterval()
+	ri := sel.resolveInterval()
+	resolved := time.Now()
+
+	logging.Logger.Info(fmt.Sprintf("successfully initialized poll group %s on server %s - interval: %s - nodes per read: %d", g.Name, s.Name, iv, chunk))
+
+	// a random offset spreads the reads of groups with the same interval
+	wait := g.jitter()
+
+	for {
+		changed := false
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		case sel = <-update:
+			logging.Logger.Info(fmt.Sprintf("applying changed nodes of poll group %s on server %s", g.Name, s.Name))
+			changed = true
+		}
+
+		start := time.Now()
+
+		if changed || (ri > 0 && start.Sub(resolved) >= ri) {
+			var added []Nodeid
+			g, added, _, _ = s.resolveGroup(ctx, c, sel)
+			nodes = s.readValueIDs(g.Nodeids)
+			resolved = start
+			s.loadTypes(ctx, c, added)
+
+			if g.Enrich {
+				s.enrich(ctx, c, added)
+			}
+
+			chunk = limit
+			if chunk <= 0 || chunk > len(nodes) {
+				chunk = len(nodes)
+			}
+		}
+
+		for i := 0; i < len(nodes); i += chunk {
+			s.readChunk(ctx, c, nodes[i:min(i+chunk, len(nodes))])
+		}
+
+		wait = iv - time.Since(start) + g.jitter()
+	}
+}
+
+func (s *OpcServer) readValueIDs(ids []Nodeid) []*ua.ReadValueID {
+
+	nodes := make([]*ua.ReadValueID, 0, len(ids))
+
+	for _, n := range ids {
+		nid, err := s.parseNodeID(n.Id)
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("error parsing node id while reading:%s", err.Error()), "func", "PollGroup")
+			continue
+		}
+		nodes = append(nodes, &ua.ReadValueID{NodeID: nid, AttributeID: ua.AttributeIDValue})
+	}
+
+	return nodes
+}
+
+// readChunk reads the nodes with a single ReadRequest and publishes the results
+func (s *OpcServer) readChunk(ctx context.Context, c *opcua.Client, nodes []*ua.ReadValueID) {
+
+	res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: nodes, TimestampsToReturn: ua.TimestampsToReturnBoth})
+
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("error occured during opc ua read request:%s", err.Error()), "func", "readChunk")
+		return
+	}
+
+	for i, r := range res.Results {
+		if i >= len(nodes) {
+			break
+		}
+
+		nid := nodes[i].NodeID
+
+		p, ok := s.valuePayload(nid, r)
+		if !ok {
+			continue
+		}
+
+		if r.Status != ua.StatusOK {
+			logging.Logger.Debug(fmt.Sprintf("received status %s for read - nodeid %s", p.Status, nid))
+		}
+
+		s.publish(ctx, p)
+	}
+}
+
+// maxNodesPerRead reads the operation limit of the server, 0 means no limit
+func maxNodesPerRead(ctx context.Context, c *opcua.Client) int {
+
+	res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: []*ua.ReadValueID{
+		{NodeID: ua.NewNumericNodeID(0, id.Server_ServerCapabilities_OperationLimits_MaxNodesPerRead), AttributeID: ua.AttributeIDValue},
+	}})
+
+	if err != nil || len(res.Results) == 0 || res.Results[0].Status != ua.StatusOK {
+		return 0
+	}
+
+	v, ok := res.Results[0].Value.Value().(uint32)
+	if !ok {
+		return 0
+	}
+
+	return int(v)
+}
+
+// jitter returns a random duration between 0 and the configured jitter of the group
+func (s *Subscription) jitter() time.Duration {
+	if s.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Float64() * s.Jitter * float64(time.Second))
+}
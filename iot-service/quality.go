@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"gualogger/handlers"
+	"strings"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// severityMask selects the severity bits of a status code, 00 is good, 01 uncertain and 1x bad
+const severityMask = 0xC0000000
+
+// qualityRank orders the qualities, so a minimum quality can be compared against the quality of a value
+var qualityRank = map[string]int{
+	handlers.QualityBad:       0,
+	handlers.QualityUncertain: 1,
+	handlers.QualityGood:      2,
+}
+
+// quality returns the quality and the symbolic name of a status code, e.g. Bad and BadNodeIdUnknown
+func quality(code ua.StatusCode) (string, string) {
+
+	q := handlers.QualityGood
+	switch {
+	case code&0x80000000 != 0:
+		q = handlers.QualityBad
+	case code&severityMask == 0x40000000:
+		q = handlers.QualityUncertain
+	}
+
+	// the lower 16 bits hold info bits like overflow or limits, which are not part of the symbolic name
+	desc, ok := ua.StatusCodes[code&0xFFFF0000]
+
+	switch {
+	case code&0xFFFF0000 == 0:
+		return q, "Good"
+	case ok:
+		return q, strings.TrimPrefix(desc.Name, "Status")
+	default:
+		return q, fmt.Sprintf("0x%08X", uint32(code))
+	}
+}
+
+// minQuality returns the lowest quality of values of the node that is still published, defaults to Bad
+func (n *Nodeid) minQuality() string {
+	switch strings.ToLower(n.MinQuality) {
+	case "good":
+		return handlers.QualityGood
+	case "uncertain":
+		return handlers.QualityUncertain
+	default:
+		return handlers.QualityBad
+	}
+}
+
+// accept reports whether a value of the given quality is published for the node
+func (s *OpcServer) accept(key string, q string) bool {
+
+	s.nodesMu.RLock()
+	defer s.nodesMu.RUnlock()
+
+	n, ok := s.nodes[key]
+	if !ok {
+		return true
+	}
+
+	return qualityRank[q] >= qualityRank[n.minQuality]
+}
+
+// valuePayload builds the payload of a data value, the second return value is false if the quality of the value is
+// below the minimum quality of the node and the value must not be published
+func (s *OpcServer) valuePayload(nid *ua.NodeID, dv *ua.DataValue) (handlers.Payload, bool) {
+
+	q, status := quality(dv.Status)
+	key := nid.String()
+
+	s.countValue(key, s.stableID(nid), q, status)
+
+	if !s.accept(key, q) {
+		return handlers.Payload{}, false
+	}
+
+	ts := dv.SourceTimestamp
+	if ts.IsZero() {
+		ts = dv.ServerTimestamp
+	}
+
+	var v interface{}
+	if dv.Value != nil {
+		v = s.normalize(dv.Value.Value())
+	}
+
+	p := handlers.Payload{
+		Value:      v,
+		TS:         ts,
+		ServerTS:   dv.ServerTimestamp,
+		Name:       nid.StringID(),
+		Id:         s.stableID(nid),
+		Datatype:   VariantDatatype(dv.Value),
+		Quality:    q,
+		StatusCode: uint32(dv.Status),
+		Status:     status,
+	}
+
+	s.describe(&p, key)
+
+	return p, true
+}
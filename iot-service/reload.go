@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/logging"
+	"gualogger/supervisor"
+	"reflect"
+	"sync"
+)
+
+// runningGroup is a subscription or poll group running on the current session
+type runningGroup struct {
+	conf   Subscription
+	cancel context.CancelFunc
+	update chan Subscription
+}
+
+// runningEvents is an event subscription running on the current session
+type runningEvents struct {
+	conf   EventSubscription
+	cancel context.CancelFunc
+}
+
+// config returns the current configuration of the server
+func (s *OpcServer) config() OpcConfig {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+	return s.conf
+}
+
+func (s *OpcServer) startGroup(o *opcSession, g Subscription) {
+
+	ctx, cancel := context.WithCancel(o.ctx)
+	r := &runningGroup{conf: g, cancel: cancel, update: make(chan Subscription, 1)}
+
+	var run func()
+
+	switch g.Mode {
+	case "", ModeSubscription:
+		run = func() { s.CreateSubscription(ctx, o.c, o.m, g, r.update) }
+	case ModePoll:
+		run = func() { s.PollGroup(ctx, o.c, g, r.update) }
+	default:
+		logging.Logger.Error(fmt.Sprintf("unknown acquisition mode %q of group %s", g.Mode, g.Name), "func", "startGroup", "server", s.Name)
+		cancel()
+		return
+	}
+
+	o.groups[g.Name] = r
+	o.wg.Add(1)
+
+	go func() {
+		defer o.wg.Done()
+		run()
+	}()
+}
+
+func (s *OpcServer) startEvents(o *opcSession, e EventSubscription) {
+
+	ctx, cancel := context.WithCancel(o.ctx)
+	o.events[e.key()] = &runningEvents{conf: e, cancel: cancel}
+	o.wg.Add(1)
+
+	go func() {
+		defer o.wg.Done()
+		s.CreateEventSubscription(ctx, o.c, e)
+	}()
+}
+
+// key identifies an event subscription across configuration changes
+func (e *EventSubscription) key() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.Notifier
+}
+
+// settings returns the group without its nodes, a change of the settings requires a new subscription
+func (g Subscription) settings() Subscription {
+	g.Nodeids = nil
+	return g
+}
+
+// Reload applies a changed configuration of the server
+// Changed connection settings reconnect the server, changed groups are restarted and changed nodes are applied
+// to the monitored items of the running subscription
+func (s *OpcServer) Reload(o OpcConfig) {
+
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	prev := s.config()
+
+	if reflect.DeepEqual(prev, o) {
+		return
+	}
+
+	s.confMu.Lock()
+	s.conf = o
+	s.confMu.Unlock()
+
+	// a server which gave up is connected again with the changed configuration
+	if s.sv.State() == supervisor.StateFailed {
+		s.sv.Reconfigure(supervisorConfig(o))
+		select {
+		case s.revive <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(prev.Connection, o.Connection) {
+		logging.Logger.Info(fmt.Sprintf("connection settings of server %s changed - reconnecting", s.Name))
+		s.sv.Reconfigure(supervisorConfig(o))
+		s.sv.Restart()
+		return
+	}
+
+	// a session which is closing is replaced by a new one with the changed configuration
+	if s.sess == nil || s.sess.ctx.Err() != nil {
+		return
+	}
+
+	s.reloadGroups(s.sess, o.SubscriptionGroups())
+	s.reloadEvents(s.sess, o.Events)
+}
+
+func (s *OpcServer) reloadGroups(o *opcSession, groups []Subscription) {
+
+	names := make(map[string]bool, len(groups))
+
+	for _, g := range groups {
+		names[g.Name] = true
+
+		r, ok := o.groups[g.Name]
+
+		switch {
+		case !ok:
+			logging.Logger.Info(fmt.Sprintf("starting new group %s on server %s", g.Name, s.Name))
+			s.startGroup(o, g)
+
+		case !reflect.DeepEqual(r.conf.settings(), g.settings()) || r.conf.hasSelectors() != g.hasSelectors():
+			logging.Logger.Info(fmt.Sprintf("settings of group %s on server %s changed - restarting group", g.Name, s.Name))
+			r.cancel()
+			s.startGroup(o, g)
+
+		case !reflect.DeepEqual(r.conf, g):
+			r.conf = g
+			// only the latest nodes are of interest, so a pending update is replaced
+			select {
+			case <-r.update:
+			default:
+			}
+			r.update <- g
+		}
+	}
+
+	for name, r := range o.groups {
+		if names[name] {
+			continue
+		}
+		logging.Logger.Info(fmt.Sprintf("stopping removed group %s on server %s", name, s.Name))
+		r.cancel()
+		delete(o.groups, name)
+		s.dropGroup(name)
+	}
+}
+
+func (s *OpcServer) reloadEvents(o *opcSession, events []EventSubscription) {
+
+	keys := make(map[string]bool, len(events))
+
+	for _, e := range events {
+		k := e.key()
+		keys[k] = true
+
+		r, ok := o.events[k]
+		if ok && reflect.DeepEqual(r.conf, e) {
+			continue
+		}
+		if ok {
+			r.cancel()
+		}
+
+		logging.Logger.Info(fmt.Sprintf("starting event subscription %s on server %s", k, s.Name))
+		s.startEvents(o, e)
+	}
+
+	for k, r := range o.events {
+		if !keys[k] {
+			logging.Logger.Info(fmt.Sprintf("stopping removed event subscription %s on server %s", k, s.Name))
+			r.cancel()
+			delete(o.events, k)
+		}
+	}
+}
+
+// ServerManager runs the supervisors of all configured servers and applies configuration changes to them
+type ServerManager struct {
+	ctx     context.Context
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	servers map[string]*managedServer
+}
+
+type managedServer struct {
+	s      *OpcServer
+	cancel context.CancelFunc
+}
+
+func NewServerManager(ctx context.Context) *ServerManager {
+	return &ServerManager{ctx: ctx, servers: make(map[string]*managedServer)}
+}
+
+// Apply starts new servers, stops removed ones and reloads the configuration of all others
+func (m *ServerManager) Apply(servers []OpcConfig) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// changes arriving during the shutdown are ignored
+	if m.ctx.Err() != nil {
+		return
+	}
+
+	names := make(map[string]bool, len(servers))
+
+	for _, o := range servers {
+		names[o.Name] = true
+
+		if ms, ok := m.servers[o.Name]; ok {
+			ms.s.Reload(o)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(m.ctx)
+		ms := &managedServer{s: NewOpcServer(o), cancel: cancel}
+		m.servers[o.Name] = ms
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			ms.s.InitSuperVisor(ctx)
+		}()
+	}
+
+	for name, ms := range m.servers {
+		if !names[name] {
+			logging.Logger.Info(fmt.Sprintf("server %s was removed from the configuration - disconnecting", name))
+			ms.cancel()
+			delete(m.servers, name)
+		}
+	}
+}
+
+// Wait blocks until all supervisors stopped
+func (m *ServerManager) Wait() {
+	m.wg.Wait()
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/logging"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// browseChunk is the maximum number of nodes browsed or read with a single request during resolution
+const browseChunk = 100
+
+// isSelector reports whether the entry selects nodes by browse path or root node instead of a node id
+func (n *Nodeid) isSelector() bool {
+	return n.BrowsePath != "" || n.Root != ""
+}
+
+// hasSelectors reports whether any node of the group has to be resolved against the server
+func (s *Subscription) hasSelectors() bool {
+	return slices.ContainsFunc(s.Nodeids, func(n Nodeid) bool { return n.isSelector() })
+}
+
+// resolveInterval returns the interval in which the selectors of the group are resolved again, 0 disables it
+func (s *Subscription) resolveInterval() time.Duration {
+	if s.ResolveInterval <= 0 || !s.hasSelectors() {
+		return 0
+	}
+	return time.Duration(s.ResolveInterval * float64(time.Second))
+}
+
+// resolveGroup replaces all selectors of the group with the matching nodes of the server
+// The resolved set is diffed against the previous resolution of the group and the topics of the nodes are updated
+// Besides the added and removed nodes, the nodes whose monitoring parameters changed are returned
+func (s *OpcServer) resolveGroup(ctx context.Context, c *opcua.Client, g Subscription) (Subscription, []Nodeid, []Nodeid, []string) {
+
+	if !g.hasSelectors() {
+		added, modified, removed := s.updateNodes(g.Name, g.Nodeids)
+		return g, added, modified, removed
+	}
+
+	nodes, err := s.resolveNodes(ctx, c, g.Nodeids)
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("error while resolving nodes of group %s: %s", g.Name, err.Error()), "func", "resolveGroup", "server", s.Name)
+
+		// keep the previous resolution, so a failed browse does not remove all nodes of the group
+		s.nodesMu.RLock()
+		prev := s.resolved[g.Name]
+		s.nodesMu.RUnlock()
+
+		if prev != nil {
+			g.Nodeids = prev
+			return g, nil, nil, nil
+		}
+
+		nodes = slices.DeleteFunc(slices.Clone(g.Nodeids), func(n Nodeid) bool { return n.isSelector() })
+	}
+
+	added, modified, removed := s.updateNodes(g.Name, nodes)
+
+	logging.Logger.Info(fmt.Sprintf("resolved %d nodes for group %s on server %s - added: %d - modified: %d - removed: %d", len(nodes), g.Name, s.Name, len(added), len(modified), len(removed)))
+
+	for _, n := range added {
+		logging.Logger.Debug(fmt.Sprintf("added node %s to group %s", n.Id, g.Name), "server", s.Name)
+	}
+	for _, id := range removed {
+		logging.Logger.Debug(fmt.Sprintf("removed node %s from group %s", id, g.Name), "server", s.Name)
+	}
+
+	g.Nodeids = nodes
+	return g, added, modified, removed
+}
+
+// updateNodes stores the resolved nodes of a group and returns the nodes added, the nodes with changed monitoring
+// parameters and the ids removed since the last call
+func (s *OpcServer) updateNodes(group string, nodes []Nodeid) ([]Nodeid, []Nodeid, []string) {
+
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+
+	prev := make(map[string]Nodeid, len(s.resolved[group]))
+	for _, n := range s.resolved[group] {
+		prev[n.Id] = n
+	}
+
+	var added, modified []Nodeid
+	for _, n := range nodes {
+		k := s.nodeKey(n.Id)
+		if info, ok := s.nodes[k]; ok {
+			info.topics, info.meta, info.minQuality, info.group = n.Topics, n.Meta, n.minQuality(), group
+		} else {
+			s.nodes[k] = &nodeInfo{topics: n.Topics, meta: n.Meta, minQuality: n.minQuality(), group: group}
+		}
+
+		if p, ok := prev[n.Id]; !ok {
+			added = append(added, n)
+		} else if !p.sameMonitoring(n) {
+			modified = append(modified, n)
+		}
+		delete(prev, n.Id)
+	}
+
+	var removed []string
+	for id := range prev {
+		delete(s.nodes, s.nodeKey(id))
+		removed = append(removed, id)
+	}
+	slices.Sort(removed)
+
+	s.resolved[group] = nodes
+	return added, modified, removed
+}
+
+// dropGroup removes the resolved nodes of a group which is no longer configured
+func (s *OpcServer) dropGroup(group string) {
+
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+
+	for _, n := range s.resolved[group] {
+		delete(s.nodes, s.nodeKey(n.Id))
+	}
+	delete(s.resolved, group)
+}
+
+// resolveNodes expands all selectors into the matching nodes, plain node ids are kept as they are
+// Every resolved node inherits the topics, meta and monitoring parameters of its selector
+func (s *OpcServer) resolveNodes(ctx context.Context, c *opcua.Client, ids []Nodeid) ([]Nodeid, error) {
+
+	res := make([]Nodeid, 0, len(ids))
+	seen := make(map[string]bool)
+
+	for _, n := range ids {
+		if !n.isSelector() {
+			if !seen[n.Id] {
+				seen[n.Id] = true
+				res = append(res, n)
+			}
+			continue
+		}
+
+		var refs []*ua.ReferenceDescription
+		var err error
+
+		if n.BrowsePath != "" {
+			refs, err = browsePath(ctx, c, n.BrowsePath)
+		} else {
+			var root *ua.NodeID
+			if root, err = s.parseNodeID(n.Root); err == nil {
+				refs, err = browseTree(ctx, c, root, n.Depth)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		refs, err = filterNodes(ctx, c, refs, n.NodeClass, n.DataType)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range refs {
+			nid := r.NodeID.NodeID.String()
+			if seen[nid] {
+				continue
+			}
+			seen[nid] = true
+
+			rn := n
+			rn.Id = nid
+			rn.BrowsePath = ""
+			rn.Root = ""
+			res = append(res, rn)
+		}
+	}
+
+	return res, nil
+}
+
+// browsePath resolves a path of browse names starting at the Root folder, e.g. /Objects/Line1/*/Temperature
+// Every segment is matched as a glob pattern, a namespace index can be given in format 2:Name
+func browsePath(ctx context.Context, c *opcua.Client, p string) ([]*ua.ReferenceDescription, error) {
+
+	current := []*ua.NodeID{ua.NewNumericNodeID(0, id.RootFolder)}
+	var refs []*ua.ReferenceDescription
+
+	for _, seg := range strings.Split(strings.Trim(p, "/"), "/") {
+		children, err := browseChildren(ctx, c, current)
+		if err != nil {
+			return nil, err
+		}
+
+		refs = refs[:0]
+		current = current[:0]
+
+		for _, r := range children {
+			if matchBrowseName(seg, r.BrowseName) {
+				refs = append(refs, r)
+				current = append(current, r.NodeID.NodeID)
+			}
+		}
+
+		if len(current) == 0 {
+			return nil, nil
+		}
+	}
+
+	return refs, nil
+}
+
+// browseTree returns all nodes below root up to the given depth, depth defaults to 1
+func browseTree(ctx context.Context, c *opcua.Client, rid *ua.NodeID, depth int) ([]*ua.ReferenceDescription, error) {
+
+	if depth <= 0 {
+		depth = 1
+	}
+
+	visited := map[string]bool{rid.String(): true}
+	current := []*ua.NodeID{rid}
+	var refs []*ua.ReferenceDescription
+
+	for level := 0; level < depth && len(current) > 0; level++ {
+		children, err := browseChildren(ctx, c, current)
+		if err != nil {
+			return nil, err
+		}
+
+		current = nil
+
+		for _, r := range children {
+			nid := r.NodeID.NodeID.String()
+			if visited[nid] {
+				continue
+			}
+			visited[nid] = true
+
+			refs = append(refs, r)
+			current = append(current, r.NodeID.NodeID)
+		}
+	}
+
+	return refs, nil
+}
+
+// browseChildren returns the targets of all forward hierarchical references of the given nodes
+func browseChildren(ctx context.Context, c *opcua.Client, nodes []*ua.NodeID) ([]*ua.ReferenceDescription, error) {
+
+	res, err := browseEach(ctx, c, nodes, ua.BrowseDirectionForward, id.HierarchicalReferences)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*ua.ReferenceDescription
+	for _, r := range res {
+		refs = append(refs, r...)
+	}
+
+	return refs, nil
+}
+
+// browseEach browses the references of the given type and its subtypes for every node
+// The result contains the references of nodes[i] at index i
+func browseEach(ctx context.Context, c *opcua.Client, nodes []*ua.NodeID, dir ua.BrowseDirection, refType uint32) ([][]*ua.ReferenceDescription, error) {
+
+	refs := make([][]*ua.ReferenceDescription, len(nodes))
+
+	for i := 0; i < len(nodes); i += browseChunk {
+		var desc []*ua.BrowseDescription
+		for _, n := range nodes[i:min(i+browseChunk, len(nodes))] {
+			desc = append(desc, &ua.BrowseDescription{
+				NodeID:          n,
+				BrowseDirection: dir,
+				ReferenceTypeID: ua.NewNumericNodeID(0, refType),
+				IncludeSubtypes: true,
+				ResultMask:      uint32(ua.BrowseResultMaskAll),
+			})
+		}
+
+		res, err := c.Browse(ctx, &ua.BrowseRequest{NodesToBrowse: desc})
+		if err != nil {
+			return nil, err
+		}
+
+		for j, r := range res.Results {
+			if i+j >= len(nodes) {
+				break
+			}
+
+			refs[i+j] = r.References
+
+			cp := r.ContinuationPoint
+			for len(cp) > 0 {
+				next, err := c.BrowseNext(ctx, &ua.BrowseNextRequest{ContinuationPoints: [][]byte{cp}})
+				if err != nil {
+					return nil, err
+				}
+				if len(next.Results) == 0 {
+					break
+				}
+				refs[i+j] = append(refs[i+j], next.Results[0].References...)
+				cp = next.Results[0].ContinuationPoint
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+func matchBrowseName(seg string, qn *ua.QualifiedName) bool {
+
+	if qn == nil {
+		return false
+	}
+
+	if ns, name, ok := strings.Cut(seg, ":"); ok {
+		if idx, err := strconv.Atoi(ns); err == nil {
+			if uint16(idx) != qn.NamespaceIndex {
+				return false
+			}
+			seg = name
+		}
+	}
+
+	ok, _ := path.Match(seg, qn.Name)
+	return ok
+}
+
+// filterNodes keeps the nodes matching the node classes and data types, only variables are kept if no node class is given
+// Data types are given as node id (i=11) or by the name of a standard data type (Double)
+func filterNodes(ctx context.Context, c *opcua.Client, refs []*ua.ReferenceDescription, classes []string, types []string) ([]*ua.ReferenceDescription, error) {
+
+	if len(classes) == 0 {
+		classes = []string{"Variable"}
+	}
+
+	refs = slices.DeleteFunc(refs, func(r *ua.ReferenceDescription) bool {
+		return !slices.ContainsFunc(classes, func(c string) bool { return ua.NodeClassFromString(c) == r.NodeClass })
+	})
+
+	if len(types) == 0 || len(refs) == 0 {
+		return refs, nil
+	}
+
+	dts := make([]*ua.NodeID, 0, len(refs))
+
+	for i := 0; i < len(refs); i += browseChunk {
+		var nodes []*ua.ReadValueID
+		for _, r := range refs[i:min(i+browseChunk, len(refs))] {
+			nodes = append(nodes, &ua.ReadValueID{NodeID: r.NodeID.NodeID, AttributeID: ua.AttributeIDDataType})
+		}
+
+		res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: nodes})
+		if err != nil {
+			return nil, err
+		}
+
+		for j := range nodes {
+			var dt *ua.NodeID
+			if j < len(res.Results) && res.Results[j].Status == ua.StatusOK {
+				dt, _ = res.Results[j].Value.Value().(*ua.NodeID)
+			}
+			dts = append(dts, dt)
+		}
+	}
+
+	var res []*ua.ReferenceDescription
+	for i, r := range refs {
+		if dts[i] != nil && matchDataType(types, dts[i]) {
+			res = append(res, r)
+		}
+	}
+
+	return res, nil
+}
+
+func matchDataType(types []string, dt *ua.NodeID) bool {
+
+	name := ""
+	if dt.Namespace() == 0 && dt.IntID() != 0 {
+		name = id.Name(dt.IntID())
+	}
+
+	for _, t := range types {
+		if t == dt.String() || (name != "" && t == name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gualogger/logging"
+	"gualogger/supervisor"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gopcua/opcua/monitor"
+)
+
+// HTTPConfig holds the settings of the health and status endpoints
+type HTTPConfig struct {
+	Address string `mapstructure:"address"`
+}
+
+// addr returns the listen address, defaults to :8080 which is the container port of the deployment
+func (h *HTTPConfig) addr() string {
+	if h.Address == "" {
+		return ":8080"
+	}
+	return h.Address
+}
+
+// activeSub is a subscription created for a group of the current session
+type activeSub struct {
+	group string
+	sub   *monitor.Subscription
+}
+
+// Status is the response of the /status endpoint
+type Status struct {
+	Ready     bool             `json:"ready"`
+	Servers   []ServerStatus   `json:"servers"`
+	Exporters []ExporterHealth `json:"exporters"`
+}
+
+// ServerStatus is a snapshot of the connection of a single opcua server
+type ServerStatus struct {
+	Name           string               `json:"name"`
+	State          string               `json:"state"`
+	Since          time.Time            `json:"since"`
+	Attempts       int                  `json:"attempts"`
+	Groups         []GroupStatus        `json:"groups"`
+	Subscriptions  []SubscriptionStatus `json:"subscriptions"`
+	LastDataChange time.Time            `json:"last_data_change,omitzero"`
+}
+
+// GroupStatus describes a group running on the current session
+type GroupStatus struct {
+	Name  string `json:"name"`
+	Mode  string `json:"mode"`
+	Nodes int    `json:"nodes"`
+}
+
+// SubscriptionStatus describes a single opcua subscription of the current session
+type SubscriptionStatus struct {
+	ID             uint32 `json:"id"`
+	Group          string `json:"group"`
+	MonitoredItems int    `json:"monitored_items"`
+	Delivered      uint64 `json:"delivered"`
+	Dropped        uint64 `json:"dropped"`
+}
+
+// Status returns a snapshot of the connection state, the running groups and subscriptions of the server
+func (s *OpcServer) Status() ServerStatus {
+
+	st := ServerStatus{
+		Name:     s.Name,
+		State:    s.sv.State().String(),
+		Since:    s.sv.Since(),
+		Attempts: s.sv.Attempts(),
+	}
+
+	if t := s.lastData.Load(); t > 0 {
+		st.LastDataChange = time.Unix(0, t)
+	}
+
+	s.sessMu.Lock()
+	if s.sess != nil && s.sess.ctx.Err() == nil {
+		for name, g := range s.sess.groups {
+			mode := g.conf.Mode
+			if mode == "" {
+				mode = ModeSubscription
+			}
+			st.Groups = append(st.Groups, GroupStatus{Name: name, Mode: mode})
+		}
+	}
+	s.sessMu.Unlock()
+
+	s.nodesMu.RLock()
+	for i, g := range st.Groups {
+		st.Groups[i].Nodes = len(s.resolved[g.Name])
+	}
+	s.nodesMu.RUnlock()
+
+	s.subsMu.Lock()
+	for id, a := range s.subs {
+		st.Subscriptions = append(st.Subscriptions, SubscriptionStatus{
+			ID:             id,
+			Group:          a.group,
+			MonitoredItems: a.sub.Subscribed(),
+			Delivered:      a.sub.Delivered(),
+			Dropped:        a.sub.Dropped(),
+		})
+	}
+	s.subsMu.Unlock()
+
+	slices.SortFunc(st.Groups, func(a, b GroupStatus) int { return strings.Compare(a.Name, b.Name) })
+	slices.SortFunc(st.Subscriptions, func(a, b SubscriptionStatus) int { return strings.Compare(a.Group, b.Group) })
+
+	return st
+}
+
+// ready reports whether the server is connected and all subscription groups created their subscription
+func (s *OpcServer) ready() error {
+
+	if st := s.sv.State(); st != supervisor.StateSubscribed {
+		return fmt.Errorf("server %s is %s", s.Name, st)
+	}
+
+	s.sessMu.Lock()
+	var groups []string
+	if s.sess != nil {
+		for name, g := range s.sess.groups {
+			if g.conf.Mode == "" || g.conf.Mode == ModeSubscription {
+				groups = append(groups, name)
+			}
+		}
+	}
+	s.sessMu.Unlock()
+
+	s.subsMu.Lock()
+	created := make(map[string]bool, len(s.subs))
+	for _, a := range s.subs {
+		created[a.group] = true
+	}
+	s.subsMu.Unlock()
+
+	for _, name := range groups {
+		if !created[name] {
+			return fmt.Errorf("subscription of group %s on server %s is not created", name, s.Name)
+		}
+	}
+
+	return nil
+}
+
+// list returns all running servers in the order of their names
+func (m *ServerManager) list() []*OpcServer {
+
+	m.mu.Lock()
+	servers := make([]*OpcServer, 0, len(m.servers))
+	for _, ms := range m.servers {
+		servers = append(servers, ms.s)
+	}
+	m.mu.Unlock()
+
+	slices.SortFunc(servers, func(a, b *OpcServer) int { return strings.Compare(a.Name, b.Name) })
+
+	return servers
+}
+
+// Status returns the state of all servers in the order of their names
+func (m *ServerManager) Status() []ServerStatus {
+
+	servers := m.list()
+
+	st := make([]ServerStatus, 0, len(servers))
+	for _, s := range servers {
+		st = append(st, s.Status())
+	}
+
+	return st
+}
+
+// ready reports whether all servers are subscribed
+func (m *ServerManager) ready() error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.servers) == 0 {
+		return errors.New("no opcua server configured")
+	}
+
+	for _, ms := range m.servers {
+		if err := ms.s.ready(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ready reports whether all exporters are reachable
+func (m *ExportManager) ready() error {
+	for _, h := range m.Health() {
+		if !h.Healthy {
+			return fmt.Errorf("exporter %s is not reachable", h.Name)
+		}
+	}
+	return nil
+}
+
+// ServeStatus serves /healthz, /readyz, /status and /metrics until ctx is done
+// /healthz only reports that the process is alive, /readyz requires active sessions, subscriptions and reachable exporters
+func ServeStatus(ctx context.Context, hc HTTPConfig, mc MetricsConfig, sm *ServerManager, em *ExportManager) {
+
+	mux := http.NewServeMux()
+
+	if h, err := metricsHandler(mc, sm, em); err != nil {
+		logging.Logger.Error(err.Error(), "func", "ServeStatus")
+	} else {
+		mux.Handle("GET /metrics", h)
+	}
+
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		err := sm.ready()
+		if err == nil {
+			err = em.ready()
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		st := Status{
+			Ready:     sm.ready() == nil && em.ready() == nil,
+			Servers:   sm.Status(),
+			Exporters: em.Health(),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	})
+
+	srv := &http.Server{Addr: hc.addr(), Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+
+	logging.Logger.Info(fmt.Sprintf("serving health, status and metrics endpoints on %s", srv.Addr))
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logging.Logger.Error(fmt.Sprintf("error while serving status endpoints: %s", err.Error()), "func", "ServeStatus")
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/logging"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// rawStructure keeps the binary body of extension objects whose type is only known by the server
+// gopcua drops the body of extension objects with unregistered encoding ids and its registry is process wide, so
+// rawStructure is registered there only as a carrier of the body. It holds no definition, every server decodes the
+// body with its own type cache
+type rawStructure struct {
+	body []byte
+}
+
+func (r *rawStructure) Decode(b []byte) (int, error) {
+	r.body = slices.Clone(b)
+	return len(b), nil
+}
+
+// captured holds the encoding ids rawStructure is registered for, the same id may be used by several servers
+var captured sync.Map
+
+// captureBody makes gopcua keep the body of extension objects with the encoding id. An id already registered for
+// another type by gopcua is left alone, its values are decoded by gopcua
+func captureBody(enc *ua.NodeID) {
+
+	if _, loaded := captured.LoadOrStore(enc.String(), true); loaded {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Logger.Debug(fmt.Sprintf("encoding %s is registered by gopcua: %v", enc, r), "func", "captureBody")
+		}
+	}()
+
+	ua.RegisterExtensionObject(enc, new(rawStructure))
+}
+
+// typeDef is the cached definition of a non builtin data type
+type typeDef struct {
+	structure *ua.StructureDefinition
+	enum      bool
+	base      *ua.NodeID
+}
+
+// typeCache holds the data type definitions of a server, structures are additionally indexed by their binary encoding id
+type typeCache struct {
+	mu       sync.RWMutex
+	defs     map[string]*typeDef
+	encoding map[string]*ua.NodeID
+}
+
+func newTypeCache() *typeCache {
+	return &typeCache{defs: make(map[string]*typeDef), encoding: make(map[string]*ua.NodeID)}
+}
+
+// reset drops all definitions, they are loaded again by the next session
+func (t *typeCache) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clear(t.defs)
+	clear(t.encoding)
+}
+
+func (t *typeCache) def(dt *ua.NodeID) *typeDef {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.defs[dt.String()]
+}
+
+func (t *typeCache) dataType(enc *ua.NodeID) *ua.NodeID {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.encoding[enc.String()]
+}
+
+func isBuiltin(dt *ua.NodeID) bool {
+	return dt.Namespace() == 0 && dt.IntID() >= uint32(ua.TypeIDBoolean) && dt.IntID() <= uint32(ua.TypeIDDiagnosticInfo)
+}
+
+// loadTypes reads the definitions of the data types of all nodes, so structured values can be decoded into named fields
+func (s *OpcServer) loadTypes(ctx context.Context, c *opcua.Client, nodes []Nodeid) {
+
+	var rv []*ua.ReadValueID
+	for _, n := range nodes {
+		if nid, err := s.parseNodeID(n.Id); err == nil {
+			rv = append(rv, &ua.ReadValueID{NodeID: nid, AttributeID: ua.AttributeIDDataType})
+		}
+	}
+
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(rv); i += browseChunk {
+		res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: rv[i:min(i+browseChunk, len(rv))]})
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("error reading data types: %s", err.Error()), "func", "loadTypes", "server", s.Name)
+			return
+		}
+
+		for _, r := range res.Results {
+			if r.Status != ua.StatusOK || r.Value == nil {
+				continue
+			}
+
+			dt, ok := r.Value.Value().(*ua.NodeID)
+			if !ok || isBuiltin(dt) || seen[dt.String()] {
+				continue
+			}
+			seen[dt.String()] = true
+
+			if err := s.types.load(ctx, c, dt); err != nil {
+				logging.Logger.Warn(fmt.Sprintf("error loading definition of data type %s: %s", dt, err.Error()), "func", "loadTypes", "server", s.Name)
+			}
+		}
+	}
+}
+
+// load reads the definition of the data type and of all types it depends on
+// Types without a DataTypeDefinition are resolved to their supertype
+func (t *typeCache) load(ctx context.Context, c *opcua.Client, dt *ua.NodeID) error {
+
+	if isBuiltin(dt) || t.def(dt) != nil {
+		return nil
+	}
+
+	def := &typeDef{}
+
+	res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: []*ua.ReadValueID{{NodeID: dt, AttributeID: ua.AttributeIDDataTypeDefinition}}})
+	if err != nil {
+		return err
+	}
+
+	if r := res.Results[0]; r.Status == ua.StatusOK && r.Value != nil {
+		if eo, ok := r.Value.Value().(*ua.ExtensionObject); ok {
+			switch v := eo.Value.(type) {
+			case *ua.StructureDefinition:
+				def.structure = v
+			case *ua.EnumDefinition:
+				def.enum = true
+			}
+		}
+	}
+
+	if def.structure == nil && !def.enum {
+		refs, err := browseEach(ctx, c, []*ua.NodeID{dt}, ua.BrowseDirectionInverse, id.HasSubtype)
+		if err != nil {
+			return err
+		}
+		if len(refs[0]) == 0 {
+			return fmt.Errorf("data type %s has neither a definition nor a supertype", dt)
+		}
+
+		def.base = refs[0][0].NodeID.NodeID
+
+		switch {
+		case def.base.Namespace() == 0 && def.base.IntID() == id.Enumeration:
+			def.enum = true
+		case def.base.Namespace() == 0 && def.base.IntID() == id.Structure:
+			return fmt.Errorf("structure %s has no DataTypeDefinition, its values are published undecoded", dt)
+		}
+	}
+
+	t.mu.Lock()
+	t.defs[dt.String()] = def
+	if def.structure != nil && def.structure.DefaultEncodingID != nil {
+		t.encoding[def.structure.DefaultEncodingID.String()] = dt
+	}
+	t.mu.Unlock()
+
+	if def.structure != nil && dt.Namespace() != 0 && def.structure.DefaultEncodingID != nil {
+		captureBody(def.structure.DefaultEncodingID)
+	}
+
+	if def.base != nil {
+		return t.load(ctx, c, def.base)
+	}
+
+	if def.structure != nil {
+		for _, f := range def.structure.Fields {
+			if err := t.load(ctx, c, f.DataType); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// encodingID returns the encoding id of an extension object with the namespace index of this server, the type id
+// may carry the namespace uri instead
+func (s *OpcServer) encodingID(tid *ua.ExpandedNodeID) *ua.NodeID {
+
+	if tid.NamespaceURI == "" {
+		return tid.NodeID
+	}
+
+	i := slices.Index(s.namespaces(), tid.NamespaceURI)
+	if i < 0 {
+		return tid.NodeID
+	}
+
+	enc := *tid.NodeID
+	if err := enc.SetNamespace(uint16(i)); err != nil {
+		// two byte ids can not carry a namespace index
+		return ua.NewNumericNodeID(uint16(i), tid.NodeID.IntID())
+	}
+	return &enc
+}
+
+// decodeStructure decodes the body of a custom structure into its named fields
+func (s *OpcServer) decodeStructure(enc *ua.NodeID, body []byte) (interface{}, error) {
+
+	dt := s.types.dataType(enc)
+	if dt == nil {
+		return nil, fmt.Errorf("unknown structure encoding %s", enc)
+	}
+
+	b := ua.NewBuffer(body)
+
+	v, err := s.decodeValue(b, dt)
+	if err != nil {
+		return nil, err
+	}
+	if b.Error() != nil {
+		return nil, b.Error()
+	}
+
+	// bytes left over mean the definition does not match the encoding of the server
+	if b.Len() > 0 {
+		return nil, fmt.Errorf("%d bytes left after decoding structure %s", b.Len(), dt)
+	}
+
+	return v, nil
+}
+
+// decodeValue decodes a value of the data type, types without a cached definition can not be skipped since their
+// length is unknown, so they fail the whole structure
+func (s *OpcServer) decodeValue(b *ua.Buffer, dt *ua.NodeID) (interface{}, error) {
+
+	if isBuiltin(dt) {
+		return s.normalize(decodeBuiltin(b, ua.TypeID(dt.IntID()))), nil
+	}
+
+	def := s.types.def(dt)
+
+	switch {
+	case def == nil:
+		return nil, fmt.Errorf("no definition of data type %s", dt)
+	case def.enum:
+		return b.ReadInt32(), nil
+	case def.base != nil:
+		return s.decodeValue(b, def.base)
+	}
+
+	sd := def.structure
+	res := make(map[string]interface{}, len(sd.Fields))
+
+	switch sd.StructureType {
+	case ua.StructureTypeUnion, ua.StructureTypeUnionWithSubtypedValues:
+		sel := b.ReadUint32()
+		if sel == 0 || int(sel) > len(sd.Fields) {
+			return res, nil
+		}
+		f := sd.Fields[sel-1]
+		v, err := s.decodeField(b, f)
+		if err != nil {
+			return nil, err
+		}
+		res[f.Name] = v
+
+	case ua.StructureTypeStructureWithOptionalFields:
+		mask := b.ReadUint32()
+		bit := 0
+		for _, f := range sd.Fields {
+			if f.IsOptional {
+				present := mask&(1<<bit) != 0
+				bit++
+				if !present {
+					continue
+				}
+			}
+			v, err := s.decodeField(b, f)
+			if err != nil {
+				return nil, err
+			}
+			res[f.Name] = v
+		}
+
+	default:
+		for _, f := range sd.Fields {
+			v, err := s.decodeField(b, f)
+			if err != nil {
+				return nil, err
+			}
+			res[f.Name] = v
+		}
+	}
+
+	return res, b.Error()
+}
+
+func (s *OpcServer) decodeField(b *ua.Buffer, f *ua.StructureField) (interface{}, error) {
+
+	if f.ValueRank < 1 {
+		v, err := s.decodeValue(b, f.DataType)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		return v, nil
+	}
+
+	n := b.ReadInt32()
+	if b.Error() != nil {
+		return nil, b.Error()
+	}
+	if n < 0 {
+		return nil, nil
+	}
+
+	arr := make([]interface{}, 0, min(n, 1024))
+	for i := int32(0); i < n; i++ {
+		v, err := s.decodeValue(b, f.DataType)
+		if err != nil {
+			return nil, fmt.Errorf("field %s[%d]: %w", f.Name, i, err)
+		}
+		if b.Error() != nil {
+			return nil, b.Error()
+		}
+		arr = append(arr, v)
+	}
+
+	return arr, nil
+}
+
+func decodeBuiltin(b *ua.Buffer, t ua.TypeID) interface{} {
+
+	switch t {
+	case ua.TypeIDBoolean:
+		return b.ReadBool()
+	case ua.TypeIDSByte:
+		return b.ReadInt8()
+	case ua.TypeIDByte:
+		return b.ReadByte()
+	case ua.TypeIDInt16:
+		return b.ReadInt16()
+	case ua.TypeIDUint16:
+		return b.ReadUint16()
+	case ua.TypeIDInt32:
+		return b.ReadInt32()
+	case ua.TypeIDUint32:
+		return b.ReadUint32()
+	case ua.TypeIDInt64:
+		return b.ReadInt64()
+	case ua.TypeIDUint64:
+		return b.ReadUint64()
+	case ua.TypeIDFloat:
+		return b.ReadFloat32()
+	case ua.TypeIDDouble:
+		return b.ReadFloat64()
+	case ua.TypeIDString, ua.TypeIDXMLElement:
+		return b.ReadString()
+	case ua.TypeIDDateTime:
+		return b.ReadTime()
+	case ua.TypeIDByteString:
+		return b.ReadBytes()
+	case ua.TypeIDStatusCode:
+		return ua.StatusCode(b.ReadUint32())
+	}
+
+	var v interface{}
+
+	switch t {
+	case ua.TypeIDGUID:
+		v = new(ua.GUID)
+	case ua.TypeIDNodeID:
+		v = new(ua.NodeID)
+	case ua.TypeIDExpandedNodeID:
+		v = new(ua.ExpandedNodeID)
+	case ua.TypeIDQualifiedName:
+		v = new(ua.QualifiedName)
+	case ua.TypeIDLocalizedText:
+		v = new(ua.LocalizedText)
+	case ua.TypeIDExtensionObject:
+		v = new(ua.ExtensionObject)
+	case ua.TypeIDDataValue:
+		v = new(ua.DataValue)
+	case ua.TypeIDVariant:
+		v = new(ua.Variant)
+	case ua.TypeIDDiagnosticInfo:
+		v = new(ua.DiagnosticInfo)
+	default:
+		return nil
+	}
+
+	b.ReadStruct(v)
+	return v
+}
+
+// normalize converts opc ua specific values into plain values, so they are serialized the same way by all exporters
+// Structures are converted into maps with the field names as keys
+func (s *OpcServer) normalize(v interface{}) interface{} {
+
+	switch t := v.(type) {
+	case nil, bool, int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64, string, []byte, time.Time:
+		return t
+	case *ua.LocalizedText:
+		return map[string]interface{}{"locale": t.Locale, "text": t.Text}
+	case *ua.QualifiedName:
+		return map[string]interface{}{"namespace_index": t.NamespaceIndex, "name": t.Name}
+	case *ua.NodeID:
+		return s.stableID(t)
+	case *ua.ExpandedNodeID:
+		return t.String()
+	case *ua.GUID:
+		return t.String()
+	case ua.StatusCode:
+		return uint32(t)
+	case *ua.XMLElement:
+		return string(*t)
+	case *ua.Variant:
+		if t == nil {
+			return nil
+		}
+		return s.normalize(t.Value())
+	case *ua.DataValue:
+		if t == nil || t.Value == nil {
+			return nil
+		}
+		return s.normalize(t.Value.Value())
+	case *ua.ExtensionObject:
+		if t == nil || t.Value == nil {
+			return nil
+		}
+		if raw, ok := t.Value.(*rawStructure); ok {
+			enc := s.encodingID(t.TypeID)
+			dv, err := s.decodeStructure(enc, raw.body)
+			if err != nil {
+				logging.Logger.Debug(fmt.Sprintf("error decoding structure %s: %s", enc, err.Error()), "server", s.Name)
+				return raw.body
+			}
+			return dv
+		}
+		return s.normalize(t.Value)
+	}
+
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if isPlain(rv.Type().Elem().Kind()) {
+			return v
+		}
+		arr := make([]interface{}, rv.Len())
+		for i := range arr {
+			arr[i] = s.normalize(rv.Index(i).Interface())
+		}
+		return arr
+
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return nil
+		}
+		return s.normalize(rv.Elem().Interface())
+
+	case reflect.Struct:
+		res := make(map[string]interface{}, rv.NumField())
+		for i := 0; i < rv.NumField(); i++ {
+			if f := rv.Type().Field(i); f.IsExported() {
+				res[f.Name] = s.normalize(rv.Field(i).Interface())
+			}
+		}
+		return res
+	}
+
+	return v
+}
+
+func isPlain(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Int16, reflect.Uint16, reflect.Int32, reflect.Uint32,
+		reflect.Int64, reflect.Uint64, reflect.Float32, reflect.Float64, reflect.String:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+var (
+	tInt32  = ua.NewNumericNodeID(0, uint32(ua.TypeIDInt32))
+	tString = ua.NewNumericNodeID(0, uint32(ua.TypeIDString))
+	tDouble = ua.NewNumericNodeID(0, uint32(ua.TypeIDDouble))
+
+	tPoint   = ua.NewNumericNodeID(2, 1000)
+	tLine    = ua.NewNumericNodeID(2, 1001)
+	tOptions = ua.NewNumericNodeID(2, 1002)
+	tSeries  = ua.NewNumericNodeID(2, 1003)
+	tChoice  = ua.NewNumericNodeID(2, 1004)
+	tMode    = ua.NewNumericNodeID(2, 1005)
+	tBroken  = ua.NewNumericNodeID(2, 1006)
+	tUnknown = ua.NewNumericNodeID(2, 1999)
+)
+
+func field(name string, dt *ua.NodeID, rank int32, optional bool) *ua.StructureField {
+	return &ua.StructureField{Name: name, DataType: dt, ValueRank: rank, IsOptional: optional}
+}
+
+// testServer returns a server with the definitions of the test structures, every structure is encoded with the
+// numeric id of its data type + 100
+func testServer() *OpcServer {
+
+	s := &OpcServer{Name: "test", types: newTypeCache()}
+
+	structure := func(dt *ua.NodeID, st ua.StructureType, fields ...*ua.StructureField) {
+		enc := ua.NewNumericNodeID(2, dt.IntID()+100)
+		s.types.defs[dt.String()] = &typeDef{structure: &ua.StructureDefinition{DefaultEncodingID: enc, StructureType: st, Fields: fields}}
+		s.types.encoding[enc.String()] = dt
+	}
+
+	structure(tPoint, ua.StructureTypeStructure, field("X", tDouble, -1, false), field("Y", tDouble, -1, false))
+	structure(tLine, ua.StructureTypeStructure, field("Name", tString, -1, false), field("From", tPoint, -1, false), field("To", tPoint, -1, false))
+	structure(tOptions, ua.StructureTypeStructureWithOptionalFields, field("Id", tInt32, -1, false), field("Label", tString, -1, true), field("Limit", tDouble, -1, true))
+	structure(tSeries, ua.StructureTypeStructure, field("Values", tInt32, 1, false), field("Points", tPoint, 1, false), field("Mode", tMode, -1, false))
+	structure(tChoice, ua.StructureTypeUnion, field("Number", tInt32, -1, false), field("Text", tString, -1, false))
+	structure(tBroken, ua.StructureTypeStructure, field("Id", tInt32, -1, false), field("Extra", tUnknown, -1, false))
+
+	s.types.defs[tMode.String()] = &typeDef{enum: true}
+
+	return s
+}
+
+func encodeBody(fn func(b *ua.Buffer)) []byte {
+	b := ua.NewBuffer(nil)
+	fn(b)
+	return b.Bytes()
+}
+
+func writePoint(b *ua.Buffer, x, y float64) {
+	b.WriteFloat64(x)
+	b.WriteFloat64(y)
+}
+
+func TestDecodeStructure(t *testing.T) {
+
+	s := testServer()
+
+	for _, tc := range []struct {
+		name    string
+		dt      *ua.NodeID
+		body    []byte
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name: "nested",
+			dt:   tLine,
+			body: encodeBody(func(b *ua.Buffer) {
+				b.WriteString("L1")
+				writePoint(b, 1, 2)
+				writePoint(b, 3, 4)
+			}),
+			want: map[string]interface{}{
+				"Name": "L1",
+				"From": map[string]interface{}{"X": 1.0, "Y": 2.0},
+				"To":   map[string]interface{}{"X": 3.0, "Y": 4.0},
+			},
+		},
+		{
+			name: "optional fields present",
+			dt:   tOptions,
+			body: encodeBody(func(b *ua.Buffer) {
+				b.WriteUint32(0b11)
+				b.WriteInt32(7)
+				b.WriteString("pump")
+				b.WriteFloat64(9.5)
+			}),
+			want: map[string]interface{}{"Id": int32(7), "Label": "pump", "Limit": 9.5},
+		},
+		{
+			name: "optional field missing",
+			dt:   tOptions,
+			body: encodeBody(func(b *ua.Buffer) {
+				b.WriteUint32(0b10)
+				b.WriteInt32(7)
+				b.WriteFloat64(9.5)
+			}),
+			want: map[string]interface{}{"Id": int32(7), "Limit": 9.5},
+		},
+		{
+			name: "arrays and enum",
+			dt:   tSeries,
+			body: encodeBody(func(b *ua.Buffer) {
+				b.WriteInt32(3)
+				b.WriteInt32(1)
+				b.WriteInt32(2)
+				b.WriteInt32(3)
+				b.WriteInt32(1)
+				writePoint(b, 5, 6)
+				b.WriteInt32(2)
+			}),
+			want: map[string]interface{}{
+				"Values": []interface{}{int32(1), int32(2), int32(3)},
+				"Points": []interface{}{map[string]interface{}{"X": 5.0, "Y": 6.0}},
+				"Mode":   int32(2),
+			},
+		},
+		{
+			name: "null array",
+			dt:   tSeries,
+			body: encodeBody(func(b *ua.Buffer) {
+				b.WriteInt32(-1)
+				b.WriteInt32(0)
+				b.WriteInt32(1)
+			}),
+			want: map[string]interface{}{"Values": nil, "Points": []interface{}{}, "Mode": int32(1)},
+		},
+		{
+			name: "union",
+			dt:   tChoice,
+			body: encodeBody(func(b *ua.Buffer) {
+				b.WriteUint32(2)
+				b.WriteString("on")
+			}),
+			want: map[string]interface{}{"Text": "on"},
+		},
+		{
+			name: "field without definition",
+			dt:   tBroken,
+			body: encodeBody(func(b *ua.Buffer) {
+				b.WriteInt32(1)
+				b.WriteInt32(2)
+			}),
+			wantErr: true,
+		},
+		{
+			name: "truncated body",
+			dt:   tLine,
+			body: encodeBody(func(b *ua.Buffer) {
+				b.WriteString("L1")
+				writePoint(b, 1, 2)
+			}),
+			wantErr: true,
+		},
+		{
+			name: "bytes left over",
+			dt:   tPoint,
+			body: encodeBody(func(b *ua.Buffer) {
+				writePoint(b, 1, 2)
+				b.WriteInt32(0)
+			}),
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+
+			enc := ua.NewNumericNodeID(2, tc.dt.IntID()+100)
+			got, err := s.decodeStructure(enc, tc.body)
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeUndecodableStructure(t *testing.T) {
+
+	s := testServer()
+
+	body := encodeBody(func(b *ua.Buffer) {
+		b.WriteInt32(1)
+		b.WriteInt32(2)
+	})
+
+	eo := &ua.ExtensionObject{
+		TypeID: ua.NewFourByteExpandedNodeID(2, uint16(tBroken.IntID()+100)),
+		Value:  &rawStructure{body: body},
+	}
+
+	// the raw body is published if the structure can not be decoded
+	if got := s.normalize(eo); !reflect.DeepEqual(got, body) {
+		t.Fatalf("expected the raw body, got %#v", got)
+	}
+}
+
+func TestNormalizeStructurePerServer(t *testing.T) {
+
+	a := testServer()
+	a.ns = []string{"http://opcfoundation.org/UA/", "urn:a", "urn:plant"}
+
+	// the second server uses the same encoding id for a structure with a different layout
+	b := &OpcServer{Name: "other", types: newTypeCache()}
+	enc := ua.NewNumericNodeID(2, tPoint.IntID()+100)
+	b.types.defs[tPoint.String()] = &typeDef{structure: &ua.StructureDefinition{DefaultEncodingID: enc, Fields: []*ua.StructureField{field("Count", tInt32, -1, false)}}}
+	b.types.encoding[enc.String()] = tPoint
+
+	point := encodeBody(func(b *ua.Buffer) { writePoint(b, 1, 2) })
+	count := encodeBody(func(b *ua.Buffer) { b.WriteInt32(5) })
+
+	for _, tc := range []struct {
+		name string
+		s    *OpcServer
+		tid  *ua.ExpandedNodeID
+		body []byte
+		want interface{}
+	}{
+		{name: "first server", s: a, tid: ua.NewFourByteExpandedNodeID(2, uint16(enc.IntID())), body: point, want: map[string]interface{}{"X": 1.0, "Y": 2.0}},
+		{name: "second server", s: b, tid: ua.NewFourByteExpandedNodeID(2, uint16(enc.IntID())), body: count, want: map[string]interface{}{"Count": int32(5)}},
+		{name: "namespace uri", s: a, tid: &ua.ExpandedNodeID{NodeID: ua.NewNumericNodeID(0, enc.IntID()), NamespaceURI: "urn:plant"}, body: point, want: map[string]interface{}{"X": 1.0, "Y": 2.0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eo := &ua.ExtensionObject{TypeID: tc.tid, Value: &rawStructure{body: tc.body}}
+
+			if got := tc.s.normalize(eo); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gualogger/logging"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopcua/opcua"
+)
+
+// State is the state of the connection to a single opcua server
+type State int32
+
+const (
+	StateConnecting State = iota
+	StateSubscribed
+	StateDegraded
+	StateReconnecting
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateSubscribed:
+		return "subscribed"
+	case StateDegraded:
+		return "degraded"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("State(%d)", int32(s))
+}
+
+// Backoff configures the delay between two connection attempts, all values are given in seconds
+// The delay starts at Initial and is multiplied with Multiplier after every failed attempt up to Max
+type Backoff struct {
+	Initial    float64 `mapstructure:"initial"`
+	Max        float64 `mapstructure:"max"`
+	Multiplier float64 `mapstructure:"multiplier"`
+}
+
+// Delay returns the delay before the given attempt, starting at 1
+// A random jitter of up to half the delay is subtracted, so servers restarting at once are not hit by all clients at the same time
+func (b Backoff) Delay(attempt int) time.Duration {
+
+	initial, limit, mult := b.Initial, b.Max, b.Multiplier
+	if initial <= 0 {
+		initial = 1
+	}
+	if limit <= 0 {
+		limit = 60
+	}
+	if mult < 1 {
+		mult = 2
+	}
+
+	d := math.Min(initial*math.Pow(mult, float64(max(attempt, 1)-1)), limit)
+	d -= rand.Float64() * d / 2
+
+	return time.Duration(d * float64(time.Second))
+}
+
+// Session is an established connection including all monitored groups of the server
+type Session interface {
+	// Check verifies that the server still answers requests on the session
+	Check(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Reconnector is implemented by sessions which have to verify the server after the client reconnected on its own
+type Reconnector interface {
+	// Reconnected returns true if the session has to be restarted, e.g. because the server changed its address space
+	Reconnected(ctx context.Context) bool
+}
+
+// ConnectFunc establishes a session, the client has to report its connection state changes to states
+// All goroutines of the session have to stop when ctx is done
+type ConnectFunc func(ctx context.Context, states chan<- opcua.ConnState) (Session, error)
+
+// Config holds the settings of a supervisor
+type Config struct {
+	Name string
+	// Retries is the number of consecutive failed connection attempts before the supervisor gives up, negative values retry forever
+	Retries int
+	Backoff Backoff
+	// CheckInterval is the interval in which the session is checked, defaults to 10s
+	CheckInterval time.Duration
+	// DegradedTimeout is the time a degraded session gets to recover before it is replaced, defaults to 60s
+	DegradedTimeout time.Duration
+}
+
+// Supervisor keeps the session to a server alive and reconnects with exponential backoff if it is lost
+//
+//	connecting -> subscribed <-> degraded
+//	     ^                          |
+//	     +------ reconnecting <-----+--> failed
+type Supervisor struct {
+	mu      sync.RWMutex
+	cfg     Config
+	connect ConnectFunc
+
+	state    atomic.Int32
+	changed  atomic.Int64
+	attempts atomic.Int32
+	restart  chan struct{}
+}
+
+// errRestart is returned by watch if a restart of the session was requested
+var errRestart = errors.New("restart requested")
+
+func New(cfg Config, connect ConnectFunc) *Supervisor {
+
+	s := &Supervisor{cfg: cfg.withDefaults(), connect: connect, restart: make(chan struct{}, 1)}
+	s.changed.Store(time.Now().UnixNano())
+
+	return s
+}
+
+func (c Config) withDefaults() Config {
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = 10 * time.Second
+	}
+	if c.DegradedTimeout <= 0 {
+		c.DegradedTimeout = 60 * time.Second
+	}
+	return c
+}
+
+// Reconfigure replaces the settings of the supervisor, they apply to the next connection attempt and session
+func (s *Supervisor) Reconfigure(cfg Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg.withDefaults()
+}
+
+func (s *Supervisor) config() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// State returns the current state of the supervisor
+func (s *Supervisor) State() State {
+	return State(s.state.Load())
+}
+
+// Since returns the time of the last state change
+func (s *Supervisor) Since() time.Time {
+	return time.Unix(0, s.changed.Load())
+}
+
+// Attempts returns the number of consecutive failed connection attempts
+func (s *Supervisor) Attempts() int {
+	return int(s.attempts.Load())
+}
+
+// Restart closes the current session and connects again without backoff, e.g. after the connection settings changed
+func (s *Supervisor) Restart() {
+	select {
+	case s.restart <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Supervisor) setState(st State) {
+	if State(s.state.Swap(int32(st))) != st {
+		s.changed.Store(time.Now().UnixNano())
+		logging.Logger.Info(fmt.Sprintf("connection to server %s is %s", s.config().Name, st))
+	}
+}
+
+// Run connects to the server and supervises the session until ctx is done
+// An error is returned if the server could not be reached within the configured number of retries
+// A supervisor which failed can be run again, it starts with a fresh number of retries
+func (s *Supervisor) Run(ctx context.Context) error {
+
+	s.attempts.Store(0)
+
+	// a restart requested while the supervisor was not running is covered by the new session
+	select {
+	case <-s.restart:
+	default:
+	}
+
+	for {
+		err := s.session(ctx)
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		cfg := s.config()
+
+		if errors.Is(err, errRestart) {
+			logging.Logger.Info(fmt.Sprintf("restarting connection to server %s", cfg.Name))
+			continue
+		}
+
+		n := int(s.attempts.Add(1))
+
+		if cfg.Retries >= 0 && n > cfg.Retries {
+			s.setState(StateFailed)
+			return fmt.Errorf("maximum number of %d retries exceeded - last error: %w", cfg.Retries, err)
+		}
+
+		d := cfg.Backoff.Delay(n)
+		s.setState(StateReconnecting)
+
+		logging.Logger.Warn(fmt.Sprintf("lost connection to server %s: %s - retry attempt %d in %s", cfg.Name, err.Error(), n, d.Round(time.Millisecond)), "func", "Run", "server", cfg.Name)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d):
+		}
+	}
+}
+
+// session establishes a single session and watches it until it is lost
+func (s *Supervisor) session(ctx context.Context) error {
+
+	s.setState(StateConnecting)
+
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	states := make(chan opcua.ConnState, 8)
+
+	sess, err := s.connect(sctx, states)
+	if err != nil {
+		return err
+	}
+
+	s.attempts.Store(0)
+	s.setState(StateSubscribed)
+
+	err = s.watch(sctx, sess, states)
+	cancel()
+
+	// the client blocks on state changes while closing, so the channel is drained until the session is closed
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-states:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	cfg := s.config()
+
+	cctx, ccancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.CheckInterval)
+	defer ccancel()
+
+	if cerr := sess.Close(cctx); cerr != nil {
+		logging.Logger.Debug(fmt.Sprintf("error closing session: %s", cerr.Error()), "server", cfg.Name)
+	}
+	close(done)
+
+	return err
+}
+
+// watch follows the connection state reported by the client and checks the session periodically
+// The session is degraded while the client reconnects or checks fail and is given up after the degraded timeout
+func (s *Supervisor) watch(ctx context.Context, sess Session, states <-chan opcua.ConnState) error {
+
+	cfg := s.config()
+
+	t := time.NewTicker(cfg.CheckInterval)
+	defer t.Stop()
+
+	var degraded time.Time
+	clientDown := false
+
+	degrade := func(reason string) {
+		if degraded.IsZero() {
+			degraded = time.Now()
+			s.setState(StateDegraded)
+			logging.Logger.Warn(fmt.Sprintf("connection to server %s degraded: %s", cfg.Name, reason), "func", "watch", "server", cfg.Name)
+		}
+	}
+
+	restore := func() {
+		if !degraded.IsZero() {
+			degraded = time.Time{}
+			s.setState(StateSubscribed)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-s.restart:
+			return errRestart
+
+		case st := <-states:
+			switch st {
+			case opcua.Connected:
+				if r, ok := sess.(Reconnector); ok && clientDown {
+					cctx, cancel := context.WithTimeout(ctx, cfg.CheckInterval)
+					restart := r.Reconnected(cctx)
+					cancel()
+
+					if restart {
+						return errRestart
+					}
+				}
+				clientDown = false
+				restore()
+			case opcua.Disconnected, opcua.Reconnecting:
+				clientDown = true
+				degrade(fmt.Sprintf("client %s", st))
+			case opcua.Closed:
+				return errors.New("client closed the connection")
+			}
+
+		case <-t.C:
+			if !clientDown {
+				cctx, cancel := context.WithTimeout(ctx, cfg.CheckInterval)
+				err := sess.Check(cctx)
+				cancel()
+
+				if err == nil {
+					restore()
+				} else {
+					degrade(err.Error())
+				}
+			}
+
+			if !degraded.IsZero() && time.Since(degraded) >= cfg.DegradedTimeout {
+				return fmt.Errorf("session did not recover within %s", cfg.DegradedTimeout)
+			}
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"gualogger/logging"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+)
+
+// fakeSession records the calls of the supervisor, the check result can be switched while the session is watched
+type fakeSession struct {
+	failing    atomic.Bool
+	closed     atomic.Bool
+	checks     atomic.Int32
+	changed    atomic.Bool
+	reconnects atomic.Int32
+}
+
+func (f *fakeSession) Check(ctx context.Context) error {
+	f.checks.Add(1)
+	if f.failing.Load() {
+		return errors.New("check failed")
+	}
+	return nil
+}
+
+func (f *fakeSession) Reconnected(ctx context.Context) bool {
+	f.reconnects.Add(1)
+	return f.changed.Load()
+}
+
+func (f *fakeSession) Close(ctx context.Context) error {
+	f.closed.Store(true)
+	return nil
+}
+
+// fakeServer hands out sessions and keeps the state channel of the latest one, so tests can emulate the client
+type fakeServer struct {
+	mu       sync.Mutex
+	sessions []*fakeSession
+	states   chan<- opcua.ConnState
+	refuse   atomic.Bool
+	connects atomic.Int32
+}
+
+func (f *fakeServer) connect(ctx context.Context, states chan<- opcua.ConnState) (Session, error) {
+	f.connects.Add(1)
+
+	if f.refuse.Load() {
+		return nil, errors.New("connection refused")
+	}
+
+	s := new(fakeSession)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sessions = append(f.sessions, s)
+	f.states = states
+
+	return s, nil
+}
+
+func (f *fakeServer) last() (*fakeSession, chan<- opcua.ConnState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.sessions) == 0 {
+		return nil, nil
+	}
+	return f.sessions[len(f.sessions)-1], f.states
+}
+
+func testConfig(retries int) Config {
+	return Config{
+		Name:            "test",
+		Retries:         retries,
+		Backoff:         Backoff{Initial: 0.001, Max: 0.005, Multiplier: 2},
+		CheckInterval:   5 * time.Millisecond,
+		DegradedTimeout: 50 * time.Millisecond,
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// start runs the supervisor until the test is finished, the result of Run is sent to the returned channel
+func start(t *testing.T, sv *Supervisor) <-chan error {
+	t.Helper()
+
+	logging.InitLogger("ERROR")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := make(chan error, 1)
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		res <- sv.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-finished
+	})
+
+	return res
+}
+
+func TestSupervisorReconnectsClosedSession(t *testing.T) {
+
+	srv := new(fakeServer)
+	sv := New(testConfig(-1), srv.connect)
+	start(t, sv)
+
+	waitFor(t, "subscribed", func() bool { return sv.State() == StateSubscribed })
+
+	first, states := srv.last()
+	states <- opcua.Closed
+
+	waitFor(t, "second session", func() bool { return srv.connects.Load() >= 2 && sv.State() == StateSubscribed })
+
+	if !first.closed.Load() {
+		t.Error("lost session was not closed")
+	}
+	if sv.Attempts() != 0 {
+		t.Errorf("attempts not reset after reconnect: %d", sv.Attempts())
+	}
+}
+
+func TestSupervisorDegradedRecovers(t *testing.T) {
+
+	srv := new(fakeServer)
+	cfg := testConfig(-1)
+	cfg.DegradedTimeout = time.Hour
+	sv := New(cfg, srv.connect)
+	start(t, sv)
+
+	waitFor(t, "subscribed", func() bool { return sv.State() == StateSubscribed })
+
+	sess, states := srv.last()
+
+	sess.failing.Store(true)
+	waitFor(t, "degraded by check", func() bool { return sv.State() == StateDegraded })
+
+	sess.failing.Store(false)
+	waitFor(t, "recovered by check", func() bool { return sv.State() == StateSubscribed })
+
+	states <- opcua.Reconnecting
+	waitFor(t, "degraded by client", func() bool { return sv.State() == StateDegraded })
+
+	// checks are suspended while the client reconnects on its own
+	n := sess.checks.Load()
+	time.Sleep(4 * cfg.CheckInterval)
+	if sess.checks.Load() != n {
+		t.Error("session checked while client is reconnecting")
+	}
+
+	states <- opcua.Connected
+	waitFor(t, "recovered by client", func() bool { return sv.State() == StateSubscribed })
+
+	if srv.connects.Load() != 1 {
+		t.Errorf("expected the session to be kept, got %d connects", srv.connects.Load())
+	}
+	if sess.reconnects.Load() != 1 {
+		t.Errorf("expected the session to verify the reconnect once, got %d", sess.reconnects.Load())
+	}
+}
+
+func TestSupervisorRestartsChangedSession(t *testing.T) {
+
+	srv := new(fakeServer)
+	cfg := testConfig(0)
+	cfg.DegradedTimeout = time.Hour
+	sv := New(cfg, srv.connect)
+	res := start(t, sv)
+
+	waitFor(t, "subscribed", func() bool { return sv.State() == StateSubscribed })
+
+	// the initial connect of the client is no reconnect
+	sess, states := srv.last()
+	states <- opcua.Connected
+	time.Sleep(4 * cfg.CheckInterval)
+	if sess.reconnects.Load() != 0 {
+		t.Fatal("session verified without a reconnect")
+	}
+
+	sess.changed.Store(true)
+	states <- opcua.Reconnecting
+	states <- opcua.Connected
+
+	waitFor(t, "restarted session", func() bool { return srv.connects.Load() == 2 && sv.State() == StateSubscribed })
+
+	if !sess.closed.Load() {
+		t.Error("changed session was not closed")
+	}
+
+	select {
+	case err := <-res:
+		t.Fatalf("supervisor stopped after restart: %v", err)
+	default:
+	}
+}
+
+func TestSupervisorReplacesDegradedSession(t *testing.T) {
+
+	srv := new(fakeServer)
+	sv := New(testConfig(-1), srv.connect)
+	start(t, sv)
+
+	waitFor(t, "subscribed", func() bool { return sv.State() == StateSubscribed })
+
+	sess, _ := srv.last()
+	sess.failing.Store(true)
+
+	waitFor(t, "replaced session", func() bool { return srv.connects.Load() >= 2 && sv.State() == StateSubscribed })
+
+	if !sess.closed.Load() {
+		t.Error("degraded session was not closed")
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+
+	srv := new(fakeServer)
+	sv := New(testConfig(0), srv.connect)
+	res := start(t, sv)
+
+	waitFor(t, "subscribed", func() bool { return sv.State() == StateSubscribed })
+
+	first, _ := srv.last()
+	sv.Restart()
+
+	waitFor(t, "restarted session", func() bool { return srv.connects.Load() == 2 && sv.State() == StateSubscribed })
+
+	if !first.closed.Load() {
+		t.Error("restarted session was not closed")
+	}
+
+	// a restart is no failed attempt, so even without retries the supervisor keeps running
+	select {
+	case err := <-res:
+		t.Fatalf("supervisor stopped after restart: %v", err)
+	default:
+	}
+}
+
+func TestSupervisorFailsAfterRetries(t *testing.T) {
+
+	srv := new(fakeServer)
+	srv.refuse.Store(true)
+
+	sv := New(testConfig(3), srv.connect)
+	res := start(t, sv)
+
+	select {
+	case err := <-res:
+		if err == nil {
+			t.Fatal("expected an error after exceeding the retries")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("supervisor did not give up")
+	}
+
+	if sv.State() != StateFailed {
+		t.Errorf("expected state failed, got %s", sv.State())
+	}
+	if n := srv.connects.Load(); n != 4 {
+		t.Errorf("expected 1 attempt and 3 retries, got %d connects", n)
+	}
+}
+
+func TestSupervisorReconfigureFailed(t *testing.T) {
+
+	srv := new(fakeServer)
+	srv.refuse.Store(true)
+
+	sv := New(testConfig(1), srv.connect)
+
+	if err := <-start(t, sv); err == nil {
+		t.Fatal("expected an error after exceeding the retries")
+	}
+
+	// the changed retries apply to the next run, which starts with a fresh number of attempts
+	sv.Reconfigure(testConfig(3))
+
+	if err := <-start(t, sv); err == nil {
+		t.Fatal("expected an error after exceeding the retries")
+	}
+	if n := srv.connects.Load(); n != 2+4 {
+		t.Fatalf("expected 2 connects of the first and 4 of the second run, got %d", n)
+	}
+
+	srv.refuse.Store(false)
+	start(t, sv)
+
+	waitFor(t, "subscribed", func() bool { return sv.State() == StateSubscribed })
+}
+
+func TestBackoffDelay(t *testing.T) {
+
+	b := Backoff{Initial: 1, Max: 8, Multiplier: 2}
+
+	for attempt, want := range []float64{1, 1, 2, 4, 8, 8} {
+		d := b.Delay(attempt).Seconds()
+		if d > want || d < want/2 {
+			t.Errorf("attempt %d: delay %.3fs not within [%.1fs, %.1fs]", attempt, d, want/2, want)
+		}
+	}
+}
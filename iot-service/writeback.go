@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// writeTimeout bounds the read of the datatype and the write of a single request
+const writeTimeout = 10 * time.Second
+
+// Write performs a write request on the addressed server, the request is rejected if the node is not writable
+// Requests for servers which are not configured are left to the connector of the server
+func (m *ServerManager) Write(ctx context.Context, req handlers.WriteRequest) (handlers.WriteAck, bool) {
+
+	s := m.server(req.Server)
+	if s == nil && req.Server != "" {
+		return handlers.WriteAck{}, false
+	}
+	if s == nil {
+		return writeAck(req, ua.StatusBadInvalidArgument, errors.New("server is required if more than one server is configured")), true
+	}
+
+	req.Server = s.Name
+
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+
+	code, err := s.write(ctx, req)
+	return writeAck(req, code, err), true
+}
+
+// server returns the named server, the name may be omitted if only one server is configured
+func (m *ServerManager) server(name string) *OpcServer {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ms, ok := m.servers[name]; ok {
+		return ms.s
+	}
+
+	if name == "" && len(m.servers) == 1 {
+		for _, ms := range m.servers {
+			return ms.s
+		}
+	}
+
+	return nil
+}
+
+func writeAck(req handlers.WriteRequest, code ua.StatusCode, err error) handlers.WriteAck {
+
+	_, status := quality(code)
+
+	ack := handlers.WriteAck{
+		CorrelationID: req.CorrelationID,
+		Server:        req.Server,
+		NodeID:        req.NodeID,
+		StatusCode:    uint32(code),
+		Status:        status,
+		TS:            time.Now(),
+	}
+
+	if err != nil {
+		ack.Error = err.Error()
+	}
+
+	return ack
+}
+
+// write checks the request against the allowlist and the datatype of the node and writes the value through the
+// client of the current session
+func (s *OpcServer) write(ctx context.Context, req handlers.WriteRequest) (ua.StatusCode, error) {
+
+	nid, err := s.parseNodeID(req.NodeID)
+	if err != nil {
+		return ua.StatusBadNodeIDInvalid, fmt.Errorf("invalid node id: %w", err)
+	}
+
+	wn, ok := s.writable(nid)
+	if !ok {
+		return ua.StatusBadUserAccessDenied, errors.New("node is not writable")
+	}
+
+	dt := req.Datatype
+	if dt == "" {
+		dt = wn.Datatype
+	}
+
+	t, ok := writeType(dt)
+	switch {
+	case dt == "":
+		return ua.StatusBadTypeMismatch, errors.New("no datatype given")
+	case !ok:
+		return ua.StatusBadTypeMismatch, fmt.Errorf("unsupported datatype %s", dt)
+	case wn.Datatype != "" && wn.Datatype != dt:
+		return ua.StatusBadTypeMismatch, fmt.Errorf("node only accepts datatype %s", wn.Datatype)
+	}
+
+	o := s.session()
+	if o == nil {
+		return ua.StatusBadServerNotConnected, errors.New("server is not connected")
+	}
+
+	// the expected datatype has to match the builtin datatype of the node, so a value is never converted by the server
+	v, err := o.c.Node(nid).Attribute(ctx, ua.AttributeIDDataType)
+	if err != nil {
+		return ua.StatusBadCommunicationError, fmt.Errorf("error reading datatype of node: %w", err)
+	}
+
+	if actual, ok := v.Value().(*ua.NodeID); ok {
+		if bt, ok := builtinType(actual); ok && bt != t {
+			return ua.StatusBadTypeMismatch, fmt.Errorf("node has datatype %s, expected %s", id.Name(actual.IntID()), id.Name(uint32(t)))
+		}
+	}
+
+	val, err := writeValue(t, req.Value)
+	if err != nil {
+		return ua.StatusBadTypeMismatch, err
+	}
+
+	res, err := o.c.Write(ctx, &ua.WriteRequest{
+		NodesToWrite: []*ua.WriteValue{{
+			NodeID:      nid,
+			AttributeID: ua.AttributeIDValue,
+			Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: val},
+		}},
+	})
+
+	if err != nil {
+		return ua.StatusBadCommunicationError, fmt.Errorf("error writing node: %w", err)
+	}
+
+	if len(res.Results) == 0 {
+		return ua.StatusBadUnexpectedError, errors.New("server returned no write result")
+	}
+
+	logging.Logger.Info(fmt.Sprintf("wrote node %s on server %s for request %s - status: %s", req.NodeID, s.Name, req.CorrelationID, res.Results[0]))
+
+	return res.Results[0], nil
+}
+
+// session returns the current session, nil if the server is not connected
+func (s *OpcServer) session() *opcSession {
+
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	if s.sess == nil || s.sess.ctx.Err() != nil {
+		return nil
+	}
+	return s.sess
+}
+
+// writable returns the allowlist entry of the node, the ids are compared after resolving namespace uris
+func (s *OpcServer) writable(nid *ua.NodeID) (WritableNode, bool) {
+
+	conf := s.config()
+
+	for _, wn := range conf.Writable {
+		w, err := s.parseNodeID(wn.Id)
+		if err != nil {
+			logging.Logger.Warn(fmt.Sprintf("invalid writable node %s: %s", wn.Id, err.Error()), "func", "writable", "server", s.Name)
+			continue
+		}
+		if w.String() == nid.String() {
+			return wn, true
+		}
+	}
+
+	return WritableNode{}, false
+}
+
+// writeTypes are the datatypes which can be written, they are given as payload label or opcua name
+var writeTypes = []ua.TypeID{
+	ua.TypeIDBoolean, ua.TypeIDSByte, ua.TypeIDByte, ua.TypeIDInt16, ua.TypeIDUint16, ua.TypeIDInt32, ua.TypeIDUint32,
+	ua.TypeIDInt64, ua.TypeIDUint64, ua.TypeIDFloat, ua.TypeIDDouble, ua.TypeIDString, ua.TypeIDDateTime,
+}
+
+// builtinType returns the builtin type a data type is encoded with. BaseDataType is abstract and accepts values of
+// any type, so it is not treated as Variant
+func builtinType(dt *ua.NodeID) (ua.TypeID, bool) {
+	if dt == nil || dt.Namespace() != 0 || dt.IntID() == id.BaseDataType || !isBuiltin(dt) {
+		return 0, false
+	}
+	return ua.TypeID(dt.IntID()), true
+}
+
+func writeType(dt string) (ua.TypeID, bool) {
+	for _, t := range writeTypes {
+		if dt == variantDatatypes[t] || dt == id.Name(uint32(t)) {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// writeValue converts the json value of a request into a variant of the given type
+func writeValue(t ua.TypeID, v interface{}) (*ua.Variant, error) {
+
+	val, err := scalarValue(t, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return ua.NewVariant(val)
+}
+
+// scalarValue converts a single json value into the go type of the given opcua type
+func scalarValue(t ua.TypeID, v interface{}) (interface{}, error) {
+
+	var val interface{}
+
+	switch t {
+	case ua.TypeIDBoolean:
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("value %v is no boolean", v)
+		}
+		val = b
+
+	case ua.TypeIDString:
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("value %v is no string", v)
+		}
+		val = str
+
+	case ua.TypeIDDateTime:
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("value %v is no RFC 3339 timestamp", v)
+		}
+		ts, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return nil, fmt.Errorf("value %v is no RFC 3339 timestamp", v)
+		}
+		val = ts
+
+	case ua.TypeIDFloat, ua.TypeIDDouble:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("value %v is no number", v)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, err
+		}
+		if t == ua.TypeIDFloat {
+			if math.Abs(f) > math.MaxFloat32 {
+				return nil, fmt.Errorf("value %v overflows Float", v)
+			}
+			val = float32(f)
+		} else {
+			val = f
+		}
+
+	default:
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("value %v is no integer", v)
+		}
+		i, err := writeInt(t, n.String())
+		if err != nil {
+			return nil, err
+		}
+		val = i
+	}
+
+	return val, nil
+}
+
+// writeInt parses an integer with the bit size and signedness of the given type
+func writeInt(t ua.TypeID, n string) (interface{}, error) {
+
+	signed := map[ua.TypeID]int{ua.TypeIDSByte: 8, ua.TypeIDInt16: 16, ua.TypeIDInt32: 32, ua.TypeIDInt64: 64}
+	unsigned := map[ua.TypeID]int{ua.TypeIDByte: 8, ua.TypeIDUint16: 16, ua.TypeIDUint32: 32, ua.TypeIDUint64: 64}
+
+	if bits, ok := signed[t]; ok {
+		i, err := strconv.ParseInt(n, 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("value %s is no %s", n, id.Name(uint32(t)))
+		}
+		switch bits {
+		case 8:
+			return int8(i), nil
+		case 16:
+			return int16(i), nil
+		case 32:
+			return int32(i), nil
+		}
+		return i, nil
+	}
+
+	u, err := strconv.ParseUint(n, 10, unsigned[t])
+	if err != nil {
+		return nil, fmt.Errorf("value %s is no %s", n, id.Name(uint32(t)))
+	}
+	switch unsigned[t] {
+	case 8:
+		return uint8(u), nil
+	case 16:
+		return uint16(u), nil
+	case 32:
+		return uint32(u), nil
+	}
+	return u, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestBuiltinType(t *testing.T) {
+
+	for _, tc := range []struct {
+		dt   *ua.NodeID
+		want ua.TypeID
+		ok   bool
+	}{
+		{dt: ua.NewNumericNodeID(0, id.Int32), want: ua.TypeIDInt32, ok: true},
+		{dt: ua.NewNumericNodeID(0, id.DiagnosticInfo), want: ua.TypeIDDiagnosticInfo, ok: true},
+		// BaseDataType is abstract, any value can be written to such a node
+		{dt: ua.NewNumericNodeID(0, id.BaseDataType)},
+		{dt: ua.NewNumericNodeID(0, id.Number)},
+		{dt: ua.NewNumericNodeID(2, id.Int32)},
+		{dt: nil},
+	} {
+		t.Run(tc.dt.String(), func(t *testing.T) {
+			got, ok := builtinType(tc.dt)
+			if got != tc.want || ok != tc.ok {
+				t.Fatalf("got %v %t, want %v %t", got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
@@ -155,6 +155,39 @@ type SubscriptionConfig struct {
 // NodeIDInfo reflects an element in the 'nodeids' list
 type NodeIDInfo struct {
 	ID string `json:"id"`
+
+	// Sampling interval in milliseconds, 0 requests the fastest rate supported by the server
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	SamplingInterval int32 `json:"sampling_interval,omitempty"`
+
+	// Number of values the server queues between two publishing cycles
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	QueueSize int32 `json:"queue_size,omitempty"`
+
+	// Value which gets discarded if the queue is full
+	// +kubebuilder:validation:Enum=oldest;newest
+	// +optional
+	DiscardPolicy string `json:"discard_policy,omitempty"`
+
+	// Changes which trigger a notification
+	// +kubebuilder:validation:Enum=status;status_value;status_value_timestamp
+	// +optional
+	Trigger string `json:"trigger,omitempty"`
+
+	// +optional
+	Deadband DeadbandConfig `json:"deadband,omitempty"`
+}
+
+// DeadbandConfig reflects the 'deadband' block of a node
+type DeadbandConfig struct {
+	// +kubebuilder:validation:Enum=none;absolute;percent
+	Type string `json:"type,omitempty"`
+
+	// Deadband in engineering units for absolute, or in percent of the EURange for percent
+	// +kubebuilder:validation:Pattern=`^[0-9]+(\.[0-9]+)?$`
+	Value string `json:"value,omitempty"`
 }
 
 // RedpandaConfig reflects the 'redpanda' block
@@ -121,6 +121,21 @@ func (in *CredentialConfig) DeepCopy() *CredentialConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeadbandConfig) DeepCopyInto(out *DeadbandConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeadbandConfig.
+func (in *DeadbandConfig) DeepCopy() *DeadbandConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(DeadbandConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GeistDeploymentSpec) DeepCopyInto(out *GeistDeploymentSpec) {
 	*out = *in
@@ -251,6 +266,7 @@ func (in *GeistConnectorStatus) DeepCopy() *GeistConnectorStatus {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NodeIDInfo) DeepCopyInto(out *NodeIDInfo) {
 	*out = *in
+	out.Deadband = in.Deadband
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeIDInfo.
@@ -28,6 +28,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -241,9 +242,27 @@ func (r *GeistConnectorReconciler) desiredDeployment(gc *v1alpha.GeistConnector)
 						Name:            "geist-connector",
 						ImagePullPolicy: pp,
 						Ports: []corev1.ContainerPort{{
-							ContainerPort: 8080, // Example port
+							ContainerPort: 8080, // health, status and metrics endpoints of the connector
 							Name:          "http",
 						}},
+						Env: []corev1.EnvVar{{
+							Name:  "GEIST_CONNECTOR", // connector label of the metrics
+							Value: gc.Name,
+						}},
+						LivenessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.FromString("http")},
+							},
+							PeriodSeconds:    10,
+							FailureThreshold: 3,
+						},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{Path: "/readyz", Port: intstr.FromString("http")},
+							},
+							PeriodSeconds:    10,
+							FailureThreshold: 3,
+						},
 						VolumeMounts: []corev1.VolumeMount{{
 							Name:      "config-volume",
 							MountPath: "/etc/config", // Path inside the container